@@ -81,6 +81,16 @@ func StartAbuseDB() error {
 			data BLOB
 		);
 		CREATE INDEX IF NOT EXISTS idx_patterns_last_ip ON patterns(last_ip);
+		CREATE TABLE IF NOT EXISTS traffic (
+			hour INTEGER,
+			backend TEXT,
+			protocol TEXT,
+			connections INTEGER,
+			bytes_in INTEGER,
+			bytes_out INTEGER,
+			duration_ms INTEGER,
+			PRIMARY KEY (hour, backend, protocol)
+		);
 	`)
 	if err != nil {
 		return fmt.Errorf("failed to create abuse database tables: %w", err)
@@ -102,6 +112,11 @@ func CleanupAbuseDB() {
 	ipExpire := now - int64(Conf.AbuseIPExpire.Duration.Seconds())
 	AbuseDB.Exec("DELETE FROM abuseipdb_cache WHERE updated_at < ?", ipExpire)
 	AbuseDB.Exec("DELETE FROM patterns WHERE confirmed = 0 AND expires_at < ?", now)
+	// 0 keeps traffic forever
+	if Conf.TrafficRetention.Duration > 0 {
+		trafficExpire := now - int64(Conf.TrafficRetention.Duration.Seconds())
+		AbuseDB.Exec("DELETE FROM traffic WHERE hour < ?", trafficExpire)
+	}
 }
 
 // AbuseIPDBCheck checks the abuse confidence score for an IP using the database cache.
@@ -223,8 +238,9 @@ func AbuseIPDBReport(
 	}
 }
 
-// record the opening bytes from abusive connections.
-func RecordAbusiveOpen(c Conn) {
+// record the opening bytes from abusive connections. Returns whatever the
+// client sent.
+func RecordAbusiveOpen(c *Conn) []byte {
 	// only read for 1 second
 	c.SetReadDeadline(time.Now().Add(Conf.AbuseRecordTime.Duration))
 	defer c.SetReadDeadline(time.Time{})
@@ -235,11 +251,11 @@ func RecordAbusiveOpen(c Conn) {
 
 	if !errors.Is(err, os.ErrDeadlineExceeded) {
 		c.Log(err)
-		return
+		return buff
 	}
 	if len(buff) == 0 {
 		c.Log("client did not send data within AbuseRecordTime")
-		return
+		return buff
 	}
 
 	hash := md5.Sum(buff)
@@ -249,7 +265,7 @@ func RecordAbusiveOpen(c Conn) {
 	pattern, err := GetPatternByHash(hexHash)
 	if err != nil {
 		c.Log("db error:", err)
-		return
+		return buff
 	}
 	if pattern != nil && pattern.Confirmed {
 		c.Log("client sent confirmed bad pattern:", hexHash)
@@ -259,7 +275,7 @@ func RecordAbusiveOpen(c Conn) {
 			Category: pattern.Category,
 			Comment:  pattern.Comment,
 		}, c.Log)
-		return
+		return buff
 	}
 
 	// Not confirmed, check IP reputation
@@ -271,11 +287,11 @@ func RecordAbusiveOpen(c Conn) {
 		count, err := CountUnconfirmedPatternsByIP(ip.String())
 		if err != nil {
 			c.Log("db error:", err)
-			return
+			return buff
 		}
 		if count >= Conf.AbusePatternsPerIP {
 			c.Log("too many unconfirmed patterns from this IP")
-			return
+			return buff
 		}
 		// Insert or update pattern
 		port := 0
@@ -286,6 +302,7 @@ func RecordAbusiveOpen(c Conn) {
 			c.Log("db error:", err)
 		}
 	}
+	return buff
 }
 
 func CheckAbusiveOpen(buff []byte) (*KnownAbusePattern, error) {
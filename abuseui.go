@@ -20,18 +20,23 @@ var templatesFS embed.FS
 
 var templates = template.Must(template.ParseFS(templatesFS, "templates/*.html"))
 
-// handleAbuseUI serves the web interface for abuse patterns.
-func handleAbuseUI(w http.ResponseWriter, r *http.Request) {
-	// Basic authentication
-	username, password, ok := r.BasicAuth()
-	usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(Conf.AuthUsername)) == 1
-	passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(Conf.AuthPassword)) == 1
-	if !ok || !usernameMatch || !passwordMatch {
-		w.Header().Set("WWW-Authenticate", "Basic realm=\"Restricted\"")
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
+// requireAuth wraps an admin page in basic authentication.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(Conf.AuthUsername)) == 1
+		passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(Conf.AuthPassword)) == 1
+		if !ok || !usernameMatch || !passwordMatch {
+			w.Header().Set("WWW-Authenticate", "Basic realm=\"Restricted\"")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
 	}
+}
 
+// handleAbuseUI serves the web interface for abuse patterns.
+func handleAbuseUI(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		serveAbusePatterns(w)
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+var ErrBackendRefused = errors.New("backend address is not allowed by policy")
+
+type addrRange struct {
+	*net.IPNet
+	reason string
+}
+
+// IPv6 ranges that are never a legitimate backend. Mostly from the IANA
+// special-purpose address registry.
+var bogonRanges = []struct{ cidr, reason string }{
+	{"::/128", "unspecified"},
+	{"::1/128", "loopback"},
+	{"::/96", "IPv4-compatible"},
+	{"::ffff:0:0/96", "IPv4-mapped"},
+	{"::ffff:0:0:0/96", "IPv4-translated"},
+	// NAT64 can reach IPv4 loopback and private space through this. Add it
+	// to BackendAllowCIDRs if you really want it.
+	{"64:ff9b::/96", "IPv4/IPv6 translation"},
+	{"64:ff9b:1::/48", "local-use IPv4/IPv6 translation"},
+	{"100::/64", "discard-only"},
+	{"2001::/23", "IETF protocol assignment"},
+	{"2001:db8::/32", "documentation"},
+	{"2002::/16", "6to4"},
+	{"3fff::/20", "documentation"},
+	{"5f00::/16", "segment routing"},
+	{"fc00::/7", "unique local"},
+	{"fe80::/10", "link local"},
+	{"fec0::/10", "site local"},
+	{"ff00::/8", "multicast"},
+}
+
+var addrPolicy struct {
+	sync.Once
+	allow []addrRange
+	deny  []addrRange
+}
+
+func parseCIDROrPanic(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse CIDR %q: %v", s, err))
+	}
+	return n
+}
+
+func loadAddrPolicy() {
+	for _, cidr := range Conf.BackendAllowCIDRs {
+		addrPolicy.allow = append(addrPolicy.allow, addrRange{
+			parseCIDROrPanic(cidr),
+			"BackendAllowCIDRs",
+		})
+	}
+
+	for _, bogon := range bogonRanges {
+		addrPolicy.deny = append(addrPolicy.deny, addrRange{
+			parseCIDROrPanic(bogon.cidr),
+			bogon.reason,
+		})
+	}
+	// don't let people point the proxy back at itself
+	addrPolicy.deny = append(addrPolicy.deny, addrRange{
+		&net.IPNet{
+			IP:   parseIPv6OrPanic(Conf.PublicIPv6Addr),
+			Mask: net.CIDRMask(128, 128),
+		},
+		"PublicIPv6Addr",
+	}, addrRange{
+		&net.IPNet{
+			IP:   parseIPv6OrPanic(Conf.MappedPrefix),
+			Mask: net.CIDRMask(96, 128),
+		},
+		"MappedPrefix",
+	})
+	for _, cidr := range Conf.BackendDenyCIDRs {
+		addrPolicy.deny = append(addrPolicy.deny, addrRange{
+			parseCIDROrPanic(cidr),
+			"BackendDenyCIDRs",
+		})
+	}
+}
+
+// CheckBackendAddr returns an error wrapping ErrBackendRefused if we should
+// not connect to ip on behalf of a client. BackendAllowCIDRs takes
+// precedence over everything else.
+func CheckBackendAddr(ip net.IP) error {
+	addrPolicy.Do(loadAddrPolicy)
+
+	if ip.To4() != nil {
+		return fmt.Errorf("%w: %s is not an IPv6 address", ErrBackendRefused, ip)
+	}
+	for _, r := range addrPolicy.allow {
+		if r.Contains(ip) {
+			return nil
+		}
+	}
+	for _, r := range addrPolicy.deny {
+		if r.Contains(ip) {
+			return fmt.Errorf("%w: %s is in %s (%s)",
+				ErrBackendRefused, ip, r.IPNet, r.reason)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestCheckBackendAddr(t *testing.T) {
+	err := LoadConfig("config.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"2600:3c00::1", true},
+		{"::", false},
+		{"::1", false},
+		{"::7f00:1", false},
+		{"::a00:1", false},
+		{"::ffff:0:7f00:1", false},
+		{"64:ff9b::7f00:1", false},
+		{"64:ff9b::a00:1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			err := CheckBackendAddr(net.ParseIP(tt.ip))
+			if tt.allowed && err != nil {
+				t.Errorf("refused: %v", err)
+			}
+			if !tt.allowed && !errors.Is(err, ErrBackendRefused) {
+				t.Errorf("err = %v, want ErrBackendRefused", err)
+			}
+		})
+	}
+}
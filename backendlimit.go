@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrBackendBusy = errors.New("backend has too many open connections")
+
+// BackendLimits keeps a single popular backend from using up our uplink.
+// Limits apply to each backend IPv6 address and to each /64.
+var BackendLimits = &backendLimiter{
+	open:    make(map[string]int),
+	shapers: make(map[string]*bandwidthShaper),
+}
+
+type backendLimiter struct {
+	sync.Mutex
+	open    map[string]int // by address or /64
+	shapers map[string]*bandwidthShaper
+
+	overridesOnce sync.Once
+	overrides     []backendOverride
+}
+
+type backendOverride struct {
+	net *net.IPNet
+	BackendOverride
+}
+
+// the limits that apply to ip, after overrides
+func (l *backendLimiter) limitsFor(ip net.IP) (maxConns, max64Conns int, bandwidth, bandwidth64 int64) {
+	l.overridesOnce.Do(func() {
+		for _, o := range Conf.BackendOverrides {
+			l.overrides = append(l.overrides, backendOverride{
+				net:             parseCIDROrPanic(o.CIDR),
+				BackendOverride: o,
+			})
+		}
+	})
+
+	for _, o := range l.overrides {
+		if o.net.Contains(ip) {
+			return o.MaxConns, o.MaxConns, o.Bandwidth, o.Bandwidth
+		}
+	}
+	return Conf.BackendMaxConns, Conf.Backend64MaxConns,
+		Conf.BackendBandwidth, Conf.Backend64Bandwidth
+}
+
+// Admit checks whether we may open another connection to ip. If we may,
+// the connection counts against ip's limits until the slot is released.
+func (l *backendLimiter) Admit(ip net.IP) (*backendSlot, error) {
+	addr := ip.String()
+	prefix := ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	maxConns, max64Conns, bandwidth, bandwidth64 := l.limitsFor(ip)
+
+	l.Lock()
+	defer l.Unlock()
+	if maxConns > 0 && l.open[addr] >= maxConns {
+		throttledConns.Add(ErrBackendBusy.Error(), 1)
+		return nil, ErrBackendBusy
+	}
+	if max64Conns > 0 && l.open[prefix] >= max64Conns {
+		throttledConns.Add(ErrBackendBusy.Error(), 1)
+		return nil, ErrBackendBusy
+	}
+
+	slot := &backendSlot{limiter: l, keys: []string{addr, prefix}}
+	for i, rate := range []int64{bandwidth, bandwidth64} {
+		key := slot.keys[i]
+		l.open[key]++
+		if rate <= 0 {
+			continue
+		}
+		shaper, ok := l.shapers[key]
+		if !ok {
+			shaper = newBandwidthShaper(rate)
+			l.shapers[key] = shaper
+		}
+		slot.shapers = append(slot.shapers, shaper)
+	}
+	return slot, nil
+}
+
+// backendSlot is one connection's share of a backend's limits. A nil slot
+// is unlimited.
+type backendSlot struct {
+	limiter  *backendLimiter
+	keys     []string
+	shapers  []*bandwidthShaper
+	released sync.Once
+}
+
+func (s *backendSlot) Release() {
+	if s == nil {
+		return
+	}
+	s.released.Do(func() {
+		l := s.limiter
+		l.Lock()
+		defer l.Unlock()
+		for _, key := range s.keys {
+			l.open[key]--
+			if l.open[key] <= 0 {
+				delete(l.open, key)
+				delete(l.shapers, key)
+			}
+		}
+	})
+}
+
+// how much to copy at a time. Smaller chunks make for smoother shaping.
+func (s *backendSlot) chunkSize() int64 {
+	chunk := int64(pipeChunk)
+	if s == nil {
+		return chunk
+	}
+	for _, shaper := range s.shapers {
+		// 100ms worth, but not so small the syscalls add up
+		chunk = min(chunk, max(shaper.rate/10, 4096))
+	}
+	return chunk
+}
+
+// account for n bytes, sleeping if we are over the bandwidth limit. This
+// slows the connection down (TCP flow control pushes back on the sender)
+// rather than dropping anything.
+func (s *backendSlot) wait(n int64) {
+	if s == nil {
+		return
+	}
+	for _, shaper := range s.shapers {
+		shaper.wait(n)
+	}
+}
+
+// a token bucket of bytes, shared by every connection to a backend. It
+// holds up to 1 second worth of bytes.
+type bandwidthShaper struct {
+	sync.Mutex
+	rate   int64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func newBandwidthShaper(rate int64) *bandwidthShaper {
+	return &bandwidthShaper{
+		rate:   rate,
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+func (b *bandwidthShaper) wait(n int64) {
+	b.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	b.tokens = min(b.tokens, float64(b.rate))
+	b.last = now
+	// going into debt means whoever comes next waits for us too
+	b.tokens -= float64(n)
+	debt := -b.tokens
+	b.Unlock()
+
+	if debt > 0 {
+		time.Sleep(time.Duration(debt / float64(b.rate) * float64(time.Second)))
+	}
+}
+
+// shapedWriter applies a Conn's backend bandwidth limits to writes, and
+// adds the bytes written to count. It looks up the slot on every write since
+// connectHTTP may change backends.
+type shapedWriter struct {
+	io.Writer
+	c     *Conn
+	count *atomic.Int64
+}
+
+func (w shapedWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.count.Add(int64(n))
+	w.c.backendSlot.wait(int64(n))
+	return n, err
+}
@@ -7,8 +7,14 @@ import (
 	"github.com/BurntSushi/toml"
 )
 
-// this is used as an array length, so it has to be compile-time constant
-const MaxLookahead = 4096
+// BackendOverride raises (or lowers) the backend limits for backends that
+// have agreed to something different.
+type BackendOverride struct {
+	CIDR string
+	// 0 for no limit
+	MaxConns  int
+	Bandwidth int64
+}
 
 type Duration struct {
 	time.Duration
@@ -33,11 +39,39 @@ var Conf struct {
 	DNSBufferSize            uint16
 	MappedPrefix             string
 	MaxConnectTime           Duration
+	DialAttemptDelay         Duration
+	NegativeCacheMin         Duration
+	NegativeCacheMax         Duration
 	MaxIdentifyTime          Duration
+	MaxLookahead             int
+	Identifiers              []string
+	HTTPRouting              string
+	DefaultActions           map[string]string
+	TarpitTime               Duration
 	MaxLookupTime            Duration
+	DrainTimeout             Duration
+	ClientIdleTimeout        Duration
+	BackendIdleTimeout       Duration
+	MaxSessionTime           Duration
+	TCPKeepAlive             Duration
 	ProxyListenAddr          string
+	FTPPassivePorts          string
+	MaxConns                 int
+	MaxConnsPerClient        int
+	ClientConnRate           float64
+	ClientConnBurst          int
+	SubnetConnRate           float64
+	SubnetConnBurst          int
+	TrustedProxyCIDRs        []string
 	PublicIPv4Addr           string
 	PublicIPv6Addr           string
+	BackendAllowCIDRs        []string
+	BackendDenyCIDRs         []string
+	BackendMaxConns          int
+	Backend64MaxConns        int
+	BackendBandwidth         int64
+	Backend64Bandwidth       int64
+	BackendOverrides         []BackendOverride
 	LogAsStringCutoff        float32
 	AbuseIPDBKey             string
 	AbuseConfidenceThreshold int
@@ -49,6 +83,7 @@ var Conf struct {
 	AbusePatternsPerIP       int
 	AbuseIPDBVerification    string
 	AbuseSavePatternAfter    int
+	TrafficRetention         Duration
 	AuthUsername             string
 	AuthPassword             string
 	PIDFile                  string
@@ -1,233 +1,444 @@
-package main
-
-import (
-	"errors"
-	"io"
-	"net"
-	"reflect"
-	"runtime"
-	"strconv"
-	"sync"
-	"time"
-)
-
-// ErrNoHost indicates that a host could not be identified
-var ErrNoHost = errors.New("a hostname could not be identified")
-var ErrAbusePattern = errors.New("hostname identification was aborted because the client sent an abusive open")
-var ErrNoV6Addr = errors.New("an IPv6 address could not be found for the given hostname")
-
-type Conn struct {
-	*net.TCPConn
-	preview        [MaxLookahead]byte
-	previewPointer int
-	eater          func(io.Reader) (int, error)
-
-	Log      func(...interface{})
-	printLog func()
-}
-
-func NewConn(tcpConn *net.TCPConn) Conn {
-	c := Conn{TCPConn: tcpConn}
-	c.Log, c.printLog = NewLog()
-	c.Log(
-		"incoming connection:",
-		c.TCPConn.RemoteAddr(),
-		"->",
-		c.TCPConn.LocalAddr(),
-	)
-	return c
-}
-
-func (c *Conn) Close() error {
-	c.Log("closing client side connection")
-
-	c.printLog()
-
-	err := c.TCPConn.Close()
-	c.TCPConn = nil
-	return err
-}
-
-func (c *Conn) DialBackend() (*net.TCPConn, error) {
-	hosts, err := c.identifyHosts()
-	if err != nil {
-		c.Log("failed to identify vhost in", c.previewPointer, "bytes:", err)
-		c.Log(c.preview[:c.previewPointer])
-		return nil, err
-	}
-	c.Log("identified", len(hosts), "possible vhosts")
-
-	var topLevelErr error
-	for _, host := range hosts {
-		c.Log("trying vhost:", host)
-
-		backendIPs, err := IPv6Lookup(host)
-		if err != nil {
-			c.Log(err)
-			topLevelErr = err
-			continue
-		}
-		if len(backendIPs) == 0 {
-			c.Log("no IPv6 addresses for", host)
-			topLevelErr = ErrNoV6Addr
-			continue
-		}
-		for _, backendIP := range backendIPs {
-			backendAddr := &net.TCPAddr{
-				IP:   backendIP,
-				Port: c.LocalAddr().(*net.TCPAddr).Port,
-			}
-			c.Log("dialing backend:", c.mappedAddr(), "->", backendAddr)
-			backendConn, err := (&net.Dialer{
-				Timeout:   Conf.MaxConnectTime.Duration,
-				LocalAddr: c.mappedAddr(),
-			}).Dial(
-				"tcp6",
-				backendAddr.String(),
-			)
-			if err != nil {
-				c.Log(err)
-				topLevelErr = err
-				continue
-			}
-
-			c.Log("backend connection established")
-			return backendConn.(*net.TCPConn), nil
-		}
-	}
-
-	return nil, topLevelErr
-}
-
-func (c *Conn) Connect(backendConn *net.TCPConn) {
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	go func() {
-		// flush preview buffer
-		bytes, err := backendConn.Write(c.preview[:c.previewPointer])
-
-		// connect client to backend traffic
-		if err == nil {
-			c.Log("flushed", bytes, "bytes from preview buffer")
-			bytes, err := io.Copy(backendConn, c.TCPConn)
-			c.Log("finished forwarding", bytes, "additional bytes from client")
-			if err != nil {
-				c.Log(err)
-			}
-		} else {
-			c.Log("error flushing preview buffer to backend:", err)
-		}
-
-		backendConn.CloseWrite()
-		wg.Done()
-	}()
-	go func() {
-		// for some protocols (ex: SMTP) we have to start speaking to know
-		// who to dial. If that happened, we need to "eat" the stuff the
-		// server is going to send that we already sent. This serves a
-		// similar function to the preview buffer.
-		if c.eater != nil {
-			c.Log("triggering eater:", functionName(c.eater))
-			bytes, err := c.eater(backendConn)
-			if err != nil {
-				c.Log(err)
-				c.CloseWrite()
-				wg.Done()
-				return
-			}
-			c.Log("ate", bytes, "bytes from server")
-		}
-
-		// connect backend to client traffic
-		bytes, err := io.Copy(c.TCPConn, backendConn)
-		c.Log("finished forwarding", bytes, "additional bytes from backend")
-		if err != nil {
-			c.Log(err)
-		}
-
-		c.CloseWrite()
-		wg.Done()
-	}()
-
-	wg.Wait()
-
-	c.Log("closing backend connection")
-	backendConn.Close()
-
-	// this is self-logging
-	c.Close()
-}
-
-func (c Conn) ClientIsIPv6() bool {
-	srcIP := c.RemoteAddr().(*net.TCPAddr).IP
-	return srcIP.To4() == nil
-}
-
-func (c *Conn) identifyHosts() (hosts []string, err error) {
-	c.SetReadDeadline(time.Now().Add(Conf.MaxIdentifyTime.Duration))
-	defer c.SetReadDeadline(time.Time{})
-
-	// if there is an error, you just don't get a port hint
-	_, portHintStr, _ := net.SplitHostPort(c.LocalAddr().String())
-	portHint, _ := strconv.ParseUint(portHintStr, 10, 32)
-	if portHint == SMTPPort {
-		bytes, err := StuffSMTP(c)
-		c.Log("stuffed", bytes, "bytes")
-		if err != nil {
-			c.Log(err)
-			return nil, err
-		}
-		c.eater = EatSMTP
-	}
-
-	for c.previewPointer < MaxLookahead {
-		readBytes, err := c.Read(c.preview[c.previewPointer:])
-		c.Log("got", readBytes, "bytes")
-		if err != nil {
-			c.Log(err)
-			return nil, err
-		}
-		c.previewPointer += readBytes
-
-		// check if the connection matches a known abuse pattern
-		pattern, err := CheckAbusiveOpen(c.preview[:c.previewPointer])
-		if err != nil {
-			c.Log("error checking for abuse pattern matches:", err)
-			// we will assume the connection is fine and keep going
-		}
-		if pattern != nil {
-			c.Log("client sent known abuse pattern", pattern.Hash, pattern.Comment)
-			ip := c.RemoteAddr().(*net.TCPAddr).IP
-			AbuseIPDBReport(ip, *pattern, c.Log)
-			return nil, ErrAbusePattern
-		}
-
-		hosts, finished := Parse(
-			c.preview[:c.previewPointer],
-			uint(portHint),
-			c.Log,
-		)
-		if finished {
-			if len(hosts) == 0 {
-				return nil, ErrNoHost
-			}
-			return hosts, nil
-		}
-	}
-	c.Log("MaxLookahead bytes exceeded")
-	return nil, ErrNoHost
-}
-
-func (c Conn) mappedAddr() *net.TCPAddr {
-	srcIP := c.RemoteAddr().(*net.TCPAddr).IP
-	srcPort := c.RemoteAddr().(*net.TCPAddr).Port
-	return &net.TCPAddr{
-		IP:   net.ParseIP(Conf.MappedPrefix + srcIP.String()),
-		Port: srcPort,
-	}
-}
-
-func functionName(i interface{}) string {
-	return runtime.FuncForPC(reflect.ValueOf(i).Pointer()).Name()
-}
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoHost indicates that a host could not be identified
+var ErrNoHost = errors.New("a hostname could not be identified")
+var ErrAbusePattern = errors.New("hostname identification was aborted because the client sent an abusive open")
+var ErrNoV6Addr = errors.New("an IPv6 address could not be found for the given hostname")
+
+type Conn struct {
+	*net.TCPConn
+	preview     []byte
+	responder   Responder
+	replayer    Replayer
+	sockets     *connSockets
+	started     time.Time
+	hosts       []string
+	backendHost string
+	backendSlot *backendSlot
+	proxyHeader []byte
+	protocol    string
+	forwarded   bool
+	sni         bool
+
+	// from AbuseIPDB, checked against each backend's policy
+	abuseConfidence int
+
+	// when data last moved in either direction, for idle timeouts
+	activity activity
+
+	// for traffic accounting. Reset when we connect to a new backend.
+	backendStarted time.Time
+	bytesToBackend atomic.Int64
+	bytesToClient  atomic.Int64
+
+	// set when a trusted load balancer tells us the real addresses
+	remoteAddr *net.TCPAddr
+	localAddr  *net.TCPAddr
+
+	Log      func(...interface{})
+	printLog func()
+}
+
+func NewConn(tcpConn *net.TCPConn) *Conn {
+	c := &Conn{
+		TCPConn: tcpConn,
+		preview: getPreviewBuffer(),
+		sockets: new(connSockets),
+		started: time.Now(),
+	}
+	c.activity.touch()
+	c.sockets.add(tcpConn)
+	setKeepAlive(tcpConn)
+	c.Log, c.printLog = NewLog()
+	c.Log(
+		"incoming connection:",
+		c.TCPConn.RemoteAddr(),
+		"->",
+		c.TCPConn.LocalAddr(),
+	)
+	return c
+}
+
+// RemoteAddr is the client's address. This is normally the socket's peer,
+// but may come from a PROXY protocol header.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.TCPConn.RemoteAddr()
+}
+
+// LocalAddr is the address the client connected to. This is normally the
+// socket's local address, but may come from a PROXY protocol header.
+func (c *Conn) LocalAddr() net.Addr {
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.TCPConn.LocalAddr()
+}
+
+// if the connection came from a trusted load balancer, read the PROXY
+// protocol header and use the addresses from it from now on.
+func (c *Conn) acceptProxyHeader() error {
+	if !IsTrustedProxy(c.TCPConn.RemoteAddr()) {
+		return nil
+	}
+
+	c.SetReadDeadline(time.Now().Add(Conf.MaxIdentifyTime.Duration))
+	defer c.SetReadDeadline(time.Time{})
+
+	src, dst, err := ReadProxyHeader(c.TCPConn)
+	if err != nil {
+		return err
+	}
+	if src == nil {
+		c.Log("PROXY protocol header without addresses")
+		return nil
+	}
+	c.Log("PROXY protocol header:", src, "->", dst)
+	c.remoteAddr = src
+	c.localAddr = dst
+	return nil
+}
+
+func (c *Conn) Close() error {
+	c.Log("closing client side connection")
+
+	c.printLog()
+
+	err := c.TCPConn.Close()
+	c.TCPConn = nil
+	c.backendSlot.Release()
+	c.backendSlot = nil
+	putPreviewBuffer(c.preview)
+	c.preview = nil
+	return err
+}
+
+// Identify works out which vhosts the client might be trying to reach.
+func (c *Conn) Identify() error {
+	hosts, err := c.identifyHosts()
+	if err != nil {
+		c.Log("failed to identify vhost in", len(c.preview), "bytes:", err)
+		c.Log(c.preview)
+		return err
+	}
+	c.Log("identified", len(hosts), "possible vhosts")
+	c.hosts = hosts
+	return nil
+}
+
+// CheckPolicy drops any vhosts whose owners don't want us proxying this
+// connection. If that leaves none, the error says why.
+func (c *Conn) CheckPolicy() error {
+	hosts, err := c.allowedHosts(c.hosts)
+	if err != nil {
+		return err
+	}
+	c.hosts = hosts
+	return nil
+}
+
+func (c *Conn) DialBackend() (*net.TCPConn, error) {
+	return c.dialHosts(c.hosts)
+}
+
+// connect to the first of hosts that works, and look up how the backend
+// wants its traffic
+func (c *Conn) dialHosts(hosts []string) (*net.TCPConn, error) {
+	c.hosts = hosts
+
+	// if we are redialing, the old backend connection is already closed
+	c.backendSlot.Release()
+	c.backendSlot = nil
+
+	candidates, err := c.backendCandidates(hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	backendConn, winner, slot, err := c.dialParallel(candidates)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBackendUnreachable, err)
+	}
+	c.Log("backend connection established")
+	c.backendSlot = slot
+	c.backendHost = winner.host
+	c.backendStarted = time.Now()
+
+	policy := LookupBackendPolicy(c.backendHost, c.Log)
+	c.proxyHeader = nil
+	switch policy.ProxyProtocol {
+	case 1:
+		c.proxyHeader = ProxyHeaderV1(
+			c.RemoteAddr().(*net.TCPAddr),
+			c.LocalAddr().(*net.TCPAddr),
+		)
+	case 2:
+		c.proxyHeader = ProxyHeaderV2(
+			c.RemoteAddr().(*net.TCPAddr),
+			c.LocalAddr().(*net.TCPAddr),
+			c.backendHost,
+		)
+	}
+	// this only works for plain HTTP, since that's the only protocol where
+	// we can see (and change) headers
+	c.forwarded = policy.Forwarded && c.protocol == "http"
+
+	return backendConn, nil
+}
+
+func (c *Conn) Connect(backendConn *net.TCPConn) {
+	// if we are cut off during a drain, the backend needs to close too
+	c.sockets.add(backendConn)
+	setKeepAlive(backendConn)
+
+	// we can only add Forwarded headers to every request if we parse them
+	if c.protocol == "http" && (httpRoutingEnabled() || c.forwarded) {
+		c.connectHTTP(backendConn)
+		return
+	}
+
+	deadline := c.sessionDeadline()
+
+	preview := c.preview
+	if c.replayer != nil {
+		var err error
+		preview, err = c.replay(backendConn, deadline)
+		if err != nil {
+			c.Log("error replaying handshake to backend:", err)
+			c.Log("closing backend connection")
+			backendConn.Close()
+			var replyErr *BackendReplyError
+			if errors.As(err, &replyErr) {
+				err = c.writeFinal(replyErr.Reply)
+				if err != nil {
+					c.Log("error passing backend reply to client:", err)
+				}
+			}
+			c.Close()
+			return
+		}
+	}
+
+	if c.protocol == "ftp" {
+		c.connectFTP(backendConn, preview, deadline)
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		// flush preview buffer (after the PROXY protocol header, if the
+		// backend asked for one)
+		if c.proxyHeader != nil {
+			c.Log("sending PROXY protocol header:", c.proxyHeader)
+		}
+		bytes, err := backendConn.Write(append(c.proxyHeader, preview...))
+
+		c.bytesToBackend.Add(int64(bytes))
+
+		// connect client to backend traffic
+		if err == nil {
+			c.Log("flushed", bytes, "bytes from preview buffer")
+			bytes, reason, clean := pipe(
+				backendConn, c.TCPConn,
+				"backend", "client",
+				Conf.ClientIdleTimeout.Duration,
+				deadline,
+				c.backendSlot,
+				&c.activity,
+			)
+			c.bytesToBackend.Add(bytes)
+			c.Log("finished forwarding", bytes, "additional bytes from client:", reason)
+			if !clean {
+				// make sure the other direction doesn't hang around
+				c.sockets.closeAll()
+			}
+		} else {
+			c.Log("error flushing preview buffer to backend:", err)
+		}
+
+		backendConn.CloseWrite()
+		wg.Done()
+	}()
+	go func() {
+		// connect backend to client traffic
+		bytes, reason, clean := pipe(
+			c.TCPConn, backendConn,
+			"client", "backend",
+			Conf.BackendIdleTimeout.Duration,
+			deadline,
+			c.backendSlot,
+			&c.activity,
+		)
+		c.bytesToClient.Add(bytes)
+		c.Log("finished forwarding", bytes, "additional bytes from backend:", reason)
+		if !clean {
+			c.sockets.closeAll()
+		}
+
+		c.CloseWrite()
+		wg.Done()
+	}()
+
+	wg.Wait()
+
+	c.Log("closing backend connection")
+	backendConn.Close()
+	c.recordTraffic()
+
+	// this is self-logging
+	c.Close()
+}
+
+// play the client's side of the handshake we faked to the backend. Returns
+// what is left of the preview buffer to send.
+func (c *Conn) replay(backendConn *net.TCPConn, deadline time.Time) ([]byte, error) {
+	backend := struct {
+		io.Reader
+		io.Writer
+	}{
+		idleReader{backendConn, Conf.BackendIdleTimeout.Duration, deadline, &c.activity},
+		idleWriter{backendConn, Conf.ClientIdleTimeout.Duration, deadline, &c.activity},
+	}
+
+	// the PROXY protocol header has to come before anything else
+	if c.proxyHeader != nil {
+		c.Log("sending PROXY protocol header:", c.proxyHeader)
+		_, err := backend.Write(c.proxyHeader)
+		if err != nil {
+			return nil, err
+		}
+		c.proxyHeader = nil
+	}
+
+	c.Log("replaying handshake:", functionName(c.replayer.Replay))
+	rest, err := c.replayer.Replay(backend, c.preview)
+	if err != nil {
+		return nil, err
+	}
+	c.Log("replayed", len(c.preview)-len(rest), "bytes of handshake")
+	return rest, nil
+}
+
+// the time at which the connection will be cut regardless of activity, or
+// zero for no limit
+func (c *Conn) sessionDeadline() time.Time {
+	if Conf.MaxSessionTime.Duration <= 0 {
+		return time.Time{}
+	}
+	return c.started.Add(Conf.MaxSessionTime.Duration)
+}
+
+func (c *Conn) ClientIsIPv6() bool {
+	srcIP := c.RemoteAddr().(*net.TCPAddr).IP
+	return srcIP.To4() == nil
+}
+
+func (c *Conn) identifyHosts() (hosts []string, err error) {
+	c.SetReadDeadline(time.Now().Add(Conf.MaxIdentifyTime.Duration))
+	defer c.SetReadDeadline(time.Time{})
+
+	// if there is an error, you just don't get a port hint
+	_, portHintStr, _ := net.SplitHostPort(c.LocalAddr().String())
+	portHint, _ := strconv.ParseUint(portHintStr, 10, 32)
+	greeter := GreeterForPort(uint(portHint))
+	if greeter != nil {
+		bytes, err := greeter.Greet(c)
+		c.Log("stuffed", bytes, "bytes")
+		if err != nil {
+			c.Log(err)
+			return nil, err
+		}
+		c.responder, _ = greeter.(Responder)
+		c.replayer, _ = greeter.(Replayer)
+	}
+
+	answered := 0
+
+	for c.growPreview() {
+		readBytes, err := c.readPreview()
+		c.Log("got", readBytes, "bytes")
+		if err != nil {
+			c.Log(err)
+			return nil, err
+		}
+
+		if c.responder != nil {
+			before := answered
+			answered, err = c.responder.Respond(c, c.preview, answered)
+			if err != nil {
+				c.Log(err)
+				return nil, err
+			}
+			// the client has to wait for our reply before it says more,
+			// so each reply gets MaxIdentifyTime of its own. MaxLookahead
+			// still limits how long this can go on.
+			if answered > before {
+				c.SetReadDeadline(nextDeadline(Conf.MaxIdentifyTime.Duration, c.sessionDeadline()))
+			}
+		}
+
+		// check if the connection matches a known abuse pattern
+		pattern, err := CheckAbusiveOpen(c.preview)
+		if err != nil {
+			c.Log("error checking for abuse pattern matches:", err)
+			// we will assume the connection is fine and keep going
+		}
+		if pattern != nil {
+			c.Log("client sent known abuse pattern", pattern.Hash, pattern.Comment)
+			ip := c.RemoteAddr().(*net.TCPAddr).IP
+			AbuseIPDBReport(ip, *pattern, c.Log)
+			return nil, ErrAbusePattern
+		}
+
+		hosts, finished := Parse(
+			c.preview,
+			uint(portHint),
+			c.Log,
+		)
+		if finished {
+			id := IdentifyProtocol(c.preview, uint(portHint))
+			c.protocol = id.name
+			c.sni = usedSNI(id, c.preview)
+			if len(hosts) == 0 {
+				return nil, ErrNoHost
+			}
+			return hosts, nil
+		}
+	}
+	c.Log("MaxLookahead bytes exceeded")
+	return nil, ErrNoHost
+}
+
+func (c *Conn) mappedAddr() *net.TCPAddr {
+	return mappedAddrFor(c.RemoteAddr().(*net.TCPAddr))
+}
+
+// the IPv6 address and port we use to talk to backends on behalf of a
+// client at addr
+func mappedAddrFor(addr *net.TCPAddr) *net.TCPAddr {
+	return &net.TCPAddr{
+		IP:   net.ParseIP(Conf.MappedPrefix + addr.IP.String()),
+		Port: addr.Port,
+	}
+}
+
+func functionName(i interface{}) string {
+	return runtime.FuncForPC(reflect.ValueOf(i).Pointer()).Name()
+}
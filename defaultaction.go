@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// values for DefaultActions. These say what to do with connections on a
+// port when we can't tell which vhost they are for.
+const (
+	// reply with an error if we can, then close (the default)
+	DefaultActionClose = "close"
+	// answer HTTP requests with the info page
+	DefaultActionInfo = "info"
+	// hold the connection open without saying anything
+	DefaultActionTarpit = "tarpit"
+	// "backend:<host>" connects to host as if the client had asked for it
+	DefaultActionBackend = "backend:"
+)
+
+// how often a tarpitted client gets to send us a byte
+const tarpitInterval = time.Second
+
+// the action configured for port, falling back to the "*" entry
+func defaultActionForPort(port int) string {
+	action, ok := Conf.DefaultActions[strconv.Itoa(port)]
+	if !ok {
+		action, ok = Conf.DefaultActions["*"]
+	}
+	if !ok {
+		return DefaultActionClose
+	}
+	return action
+}
+
+// isUnidentified reports whether err means we don't know which vhost the
+// client wants, as opposed to the client misbehaving.
+func isUnidentified(err error) bool {
+	// a timeout here usually means a protocol where the server speaks first
+	return errors.Is(err, ErrNoHost) || errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// DefaultAction handles a connection we couldn't find a vhost for the way
+// DefaultActions says to. If it returns true the connection has been dealt
+// with (and closed). Otherwise the caller should handle err as usual.
+func (c *Conn) DefaultAction(err error) bool {
+	if !isUnidentified(err) {
+		return false
+	}
+
+	port := c.LocalAddr().(*net.TCPAddr).Port
+	action := defaultActionForPort(port)
+	switch {
+	case action == DefaultActionClose:
+		return false
+	case action == DefaultActionInfo:
+		if c.protocol != "http" {
+			c.Log("not serving the info page to a", c.protocol, "client")
+			return false
+		}
+		c.Log("serving the info page")
+		c.serveInfoPage()
+		c.Close()
+		return true
+	case action == DefaultActionTarpit:
+		c.Log("tarpitting")
+		c.tarpit()
+		c.Close()
+		return true
+	case strings.HasPrefix(action, DefaultActionBackend):
+		host := strings.TrimPrefix(action, DefaultActionBackend)
+		c.Log("using the default backend:", host)
+		c.hosts = []string{host}
+		err := c.CheckPolicy()
+		var backend *net.TCPConn
+		if err == nil {
+			backend, err = c.DialBackend()
+		}
+		if err != nil {
+			c.ReplyError(c.preview, err)
+			c.Close()
+			return true
+		}
+		c.Connect(backend)
+		return true
+	default:
+		c.Log("unknown default action for port", port, ":", action)
+		return false
+	}
+}
+
+func (c *Conn) serveInfoPage() {
+	var resp bytes.Buffer
+	fmt.Fprintf(&resp, "HTTP/1.1 200 OK\r\n")
+	fmt.Fprintf(&resp, "Content-Type: text/html; charset=utf-8\r\n")
+	fmt.Fprintf(&resp, "Content-Length: %d\r\n", len(readmeHTML))
+	fmt.Fprintf(&resp, "Connection: close\r\n")
+	fmt.Fprintf(&resp, "\r\n")
+	resp.Write(readmeHTML)
+
+	err := c.writeFinal(resp.Bytes())
+	if err != nil {
+		c.Log("error sending info page:", err)
+		return
+	}
+	c.Log("replying with HTTP", http.StatusOK)
+}
+
+// keep the client waiting for TarpitTime. We only read a byte now and then,
+// so whatever it sends piles up on its end.
+func (c *Conn) tarpit() {
+	c.SetReadBuffer(1)
+	deadline := time.Now().Add(Conf.TarpitTime.Duration)
+	b := make([]byte, 1)
+	for time.Now().Before(deadline) {
+		c.SetReadDeadline(deadline)
+		_, err := c.Read(b)
+		if err != nil {
+			c.Log("tarpit ended:", err)
+			return
+		}
+		time.Sleep(tarpitInterval)
+	}
+	c.Log("tarpit ended after", Conf.TarpitTime.Duration)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var ErrNoCandidates = errors.New("no backend addresses to dial")
+
+type backendCandidate struct {
+	host string
+	addr *net.TCPAddr
+}
+
+type dialResult struct {
+	attempt int
+	conn    *net.TCPConn
+	slot    *backendSlot
+	err     error
+	elapsed time.Duration
+}
+
+// look up all hosts in parallel and return every address we are allowed to
+// dial, in the same order as hosts. If there are no candidates, the error is
+// the last thing that went wrong.
+func (c *Conn) backendCandidates(hosts []string) ([]backendCandidate, error) {
+	clientPort := c.LocalAddr().(*net.TCPAddr).Port
+	lookups := make([][]net.IP, len(hosts))
+	ports := make([][]int, len(hosts))
+	lookupErrs := make([]error, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		err := NegativeCache.Check(lookupCacheKey(host))
+		if err != nil {
+			c.Log("failing fast, lookup for", host, "recently failed")
+			lookupErrs[i] = err
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lookups[i], lookupErrs[i] = IPv6Lookup(host)
+			if lookupErrs[i] == nil && len(lookups[i]) == 0 {
+				lookupErrs[i] = ErrNoV6Addr
+			}
+			if cacheableLookupErr(lookupErrs[i]) {
+				NegativeCache.Fail(lookupCacheKey(host), lookupErrs[i])
+			}
+			if lookupErrs[i] == nil {
+				ports[i] = c.backendPorts(lookups[i], clientPort)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var candidates []backendCandidate
+	// ex: two MX names for the same server. Our attempts all use the same
+	// source port, so a second attempt to the same address would only fail
+	// with EADDRINUSE.
+	seen := make(map[string]bool)
+	topLevelErr := ErrNoCandidates
+	for i, host := range hosts {
+		if errors.Is(lookupErrs[i], ErrNoV6Addr) {
+			c.Log("no IPv6 addresses for", host)
+			topLevelErr = ErrNoV6Addr
+			continue
+		}
+		if lookupErrs[i] != nil {
+			c.Log(lookupErrs[i])
+			topLevelErr = lookupErrs[i]
+			continue
+		}
+
+		for j, backendIP := range lookups[i] {
+			err := CheckBackendAddr(backendIP)
+			if err != nil {
+				c.Log("refusing backend:", err)
+				topLevelErr = err
+				continue
+			}
+			backendPort := ports[i][j]
+			if backendPort != clientPort {
+				c.Log("remapping port", clientPort, "to", backendPort, "for", backendIP)
+			}
+			addr := &net.TCPAddr{
+				IP:   backendIP,
+				Port: backendPort,
+			}
+			if seen[addr.String()] {
+				continue
+			}
+			seen[addr.String()] = true
+			err = NegativeCache.Check(dialCacheKey(addr))
+			if err == nil {
+				err = NegativeCache.Check(clientDialCacheKey(c.mappedAddr().IP, addr))
+			}
+			if err != nil {
+				c.Log("failing fast,", addr, "recently failed:", err)
+				topLevelErr = fmt.Errorf("%w: %w", ErrBackendUnreachable, err)
+				continue
+			}
+			candidates = append(candidates, backendCandidate{
+				host: host,
+				addr: addr,
+			})
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, topLevelErr
+	}
+	return candidates, nil
+}
+
+// the port to dial on each of ips. The owner of the address may run the
+// service on a different port. Each policy lookup may have to ask the
+// backend's own DNS server, so we do them all at once.
+func (c *Conn) backendPorts(ips []net.IP, clientPort int) []int {
+	ports := make([]int, len(ips))
+	var wg sync.WaitGroup
+	for i, ip := range ips {
+		if CheckBackendAddr(ip) != nil {
+			// we won't dial it, so don't ask it anything
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ports[i] = LookupBackendPolicy(IPv6Name(ip), c.Log).BackendPort(clientPort)
+		}()
+	}
+	wg.Wait()
+	return ports
+}
+
+// all our dial attempts for a given client use the same mapped source
+// address and port, which the kernel will only allow if every socket has
+// SO_REUSEADDR set.
+func reuseAddr(network, address string, rc syscall.RawConn) error {
+	var sockErr error
+	err := rc.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(
+			int(fd),
+			syscall.SOL_SOCKET,
+			syscall.SO_REUSEADDR,
+			1,
+		)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// dial candidates in order, starting a new attempt every DialAttemptDelay
+// (or immediately when an attempt fails) without waiting for earlier
+// attempts to finish. The first successful connection wins and the rest are
+// cancelled. This is based on RFC 8305 (Happy Eyeballs v2).
+//
+// Each attempt takes a slot from BackendLimits before it dials, so we never
+// connect to a backend that is already at its limit. Only the winner keeps
+// its slot.
+func (c *Conn) dialParallel(candidates []backendCandidate) (*net.TCPConn, backendCandidate, *backendSlot, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src := c.mappedAddr()
+	dialer := &net.Dialer{
+		Timeout:   Conf.MaxConnectTime.Duration,
+		LocalAddr: src,
+		KeepAlive: Conf.TCPKeepAlive.Duration,
+		Control:   reuseAddr,
+	}
+	results := make(chan dialResult, len(candidates))
+	startAttempt := func(i int) {
+		candidate := candidates[i]
+		c.Log(fmt.Sprintf(
+			"attempt %d: dialing backend for %s: %s -> %s",
+			i, candidate.host, dialer.LocalAddr, candidate.addr,
+		))
+		go func() {
+			start := time.Now()
+			slot, err := BackendLimits.Admit(candidate.addr.IP)
+			if err != nil {
+				results <- dialResult{attempt: i, err: err}
+				return
+			}
+			conn, err := dialer.DialContext(ctx, "tcp6", candidate.addr.String())
+			result := dialResult{
+				attempt: i,
+				slot:    slot,
+				err:     err,
+				elapsed: time.Since(start),
+			}
+			if err == nil {
+				result.conn = conn.(*net.TCPConn)
+			} else {
+				slot.Release()
+			}
+			results <- result
+		}()
+	}
+
+	next := 0
+	pending := 0
+	startAttempt(next)
+	next++
+	pending++
+
+	delay := time.NewTimer(Conf.DialAttemptDelay.Duration)
+	defer delay.Stop()
+
+	var lastErr error
+	for pending > 0 {
+		select {
+		case <-delay.C:
+			if next < len(candidates) {
+				startAttempt(next)
+				next++
+				pending++
+				delay.Reset(Conf.DialAttemptDelay.Duration)
+			}
+		case result := <-results:
+			pending--
+			addr := candidates[result.attempt].addr
+			if result.err == nil {
+				NegativeCache.Succeed(dialCacheKey(addr))
+				NegativeCache.Succeed(clientDialCacheKey(src.IP, addr))
+				c.Log(fmt.Sprintf(
+					"attempt %d: connected in %s",
+					result.attempt, result.elapsed,
+				))
+				if pending > 0 {
+					c.Log("cancelling", pending, "other attempts")
+					go closeLosers(results, pending)
+				}
+				return result.conn, candidates[result.attempt], result.slot, nil
+			}
+
+			c.Log(fmt.Sprintf(
+				"attempt %d: failed after %s: %v",
+				result.attempt, result.elapsed, result.err,
+			))
+			key, ok := dialFailureKey(src.IP, addr, result.err)
+			if ok {
+				NegativeCache.Fail(key, result.err)
+			}
+			lastErr = result.err
+			// no need to wait out the delay after a failure
+			if next < len(candidates) {
+				startAttempt(next)
+				next++
+				pending++
+				delay.Reset(Conf.DialAttemptDelay.Duration)
+			}
+		}
+	}
+
+	return nil, backendCandidate{}, nil, lastErr
+}
+
+// cancelled attempts may still succeed if they were already connected, so
+// close anything that comes back.
+func closeLosers(results <-chan dialResult, pending int) {
+	for ; pending > 0; pending-- {
+		result := <-results
+		if result.conn != nil {
+			result.conn.Close()
+		}
+		result.slot.Release()
+	}
+}
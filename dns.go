@@ -30,23 +30,29 @@ func StartDNS(tf *TableFlip) {
 		panic(fmt.Sprintf("failed to listen on TCP: %v", err))
 	}
 
+	udpServer := &dns.Server{
+		PacketConn: udp,
+		Handler:    mux,
+		UDPSize:    int(Conf.DNSBufferSize),
+	}
+	tcpServer := &dns.Server{
+		Listener: tcp,
+		Handler:  mux,
+	}
+	tf.OnExit(func() {
+		udpServer.Shutdown()
+		tcpServer.Shutdown()
+	})
+
+	// ActivateAndServe returns nil after Shutdown
 	go func() {
-		server := &dns.Server{
-			PacketConn: udp,
-			Handler:    mux,
-			UDPSize:    int(Conf.DNSBufferSize),
-		}
-		err := server.ActivateAndServe()
+		err := udpServer.ActivateAndServe()
 		if err != nil {
 			panic(err)
 		}
 	}()
 	go func() {
-		server := &dns.Server{
-			Listener: tcp,
-			Handler:  mux,
-		}
-		err := server.ActivateAndServe()
+		err := tcpServer.ActivateAndServe()
 		if err != nil {
 			panic(err)
 		}
@@ -260,6 +266,17 @@ func IPv6Extract(q string) net.IP {
 	return ip
 }
 
+// the reverse of IPv6Extract. Ex: 2001:db8::1 ->
+// 2001-0db8-0000-0000-0000-0000-0000-0001.withfallback.com.
+func IPv6Name(ip net.IP) string {
+	ip = ip.To16()
+	groups := make([]string, 8)
+	for i := range groups {
+		groups[i] = fmt.Sprintf("%02x%02x", ip[2*i], ip[2*i+1])
+	}
+	return strings.Join(groups, "-") + "." + Conf.DNSZone
+}
+
 func parseIPv6OrPanic(s string) net.IP {
 	ip := net.ParseIP(s)
 	if ip == nil {
@@ -281,6 +298,12 @@ func parseIPv4OrPanic(s string) net.IP {
 
 // BUG(jon): re-use proxy logic from recurse
 func proxyRecords(dnsServer net.IP, question dns.Question) (r []dns.RR) {
+	err := CheckBackendAddr(dnsServer)
+	if err != nil {
+		Log("refusing DNS passthrough:", err)
+		return nil
+	}
+
 	ctx, cancel := context.WithTimeout(
 		context.Background(),
 		Conf.DNSPassthroughTimeout.Duration,
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ActiveConns tracks proxied connections so that an old process can wait
+// for them to finish after TableFlip hands our listeners to a new process.
+var ActiveConns = &connRegistry{conns: make(map[*Conn]struct{})}
+
+type connRegistry struct {
+	sync.Mutex
+	conns map[*Conn]struct{}
+	empty chan struct{} // closed when conns becomes empty (if non-nil)
+}
+
+// sockets belonging to a single Conn
+type connSockets struct {
+	sync.Mutex
+	conns []*net.TCPConn
+}
+
+func (s *connSockets) add(conn *net.TCPConn) {
+	s.Lock()
+	defer s.Unlock()
+	s.conns = append(s.conns, conn)
+}
+
+func (s *connSockets) closeAll() {
+	s.Lock()
+	defer s.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (r *connRegistry) Add(c *Conn) {
+	r.Lock()
+	defer r.Unlock()
+	r.conns[c] = struct{}{}
+}
+
+func (r *connRegistry) Remove(c *Conn) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.conns, c)
+	if len(r.conns) == 0 && r.empty != nil {
+		close(r.empty)
+		r.empty = nil
+	}
+}
+
+// wait up to timeout for all connections to close. Returns false if there
+// were still connections open when the timeout expired.
+func (r *connRegistry) wait(timeout time.Duration) bool {
+	r.Lock()
+	if len(r.conns) == 0 {
+		r.Unlock()
+		return true
+	}
+	if r.empty == nil {
+		r.empty = make(chan struct{})
+	}
+	empty := r.empty
+	r.Unlock()
+
+	select {
+	case <-empty:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Drain waits for open connections to finish on their own. Any that are
+// still open after timeout are cut by closing both the client and backend
+// sockets. This should only be called after we have stopped accepting new
+// connections.
+func (r *connRegistry) Drain(timeout time.Duration) (drained, cut int) {
+	r.Lock()
+	total := len(r.conns)
+	r.Unlock()
+
+	if r.wait(timeout) {
+		return total, 0
+	}
+
+	r.Lock()
+	cut = len(r.conns)
+	for c := range r.conns {
+		c.sockets.closeAll()
+	}
+	r.Unlock()
+
+	// closing the sockets should make the copy loops exit almost
+	// immediately. Give them a moment to write their logs.
+	r.wait(5 * time.Second)
+
+	return total - cut, cut
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var ErrAbuseBlocked = errors.New("client was blocked because of its abuse score")
+var ErrBackendUnreachable = errors.New("the backend could not be reached")
+
+// https://www.rfc-editor.org/rfc/rfc8446#section-6
+const (
+	tlsAlertHandshakeFailure = 40
+	tlsAlertAccessDenied     = 49
+	tlsAlertUnrecognizedName = 112
+)
+
+type errorPage struct {
+	Status  int
+	Title   string
+	Message string
+	Host    string
+	Port    int
+	Zone    string
+
+	tlsAlert byte
+	// the problem might go away on its own (ex: a DNS timeout)
+	temporary bool
+}
+
+// decide what to tell the client about err. ok is false for errors the
+// client doesn't deserve (or wouldn't understand) an explanation for.
+func explainError(err error) (page errorPage, ok bool) {
+	switch {
+	case errors.Is(err, ErrAbuseBlocked):
+		return errorPage{
+			Status:   http.StatusForbidden,
+			Title:    "Blocked for abuse",
+			Message:  "Your IP address has been reported for abuse, so this proxy will not forward your connection.",
+			tlsAlert: tlsAlertHandshakeFailure,
+		}, true
+	case errors.Is(err, ErrBackendRefused):
+		return errorPage{
+			Status:   http.StatusForbidden,
+			Title:    "Backend not allowed",
+			Message:  "The IPv6 address for this site is not one this proxy is allowed to connect to.",
+			tlsAlert: tlsAlertHandshakeFailure,
+		}, true
+	case errors.Is(err, ErrBackendOptedOut):
+		return errorPage{
+			Status:   http.StatusForbidden,
+			Title:    "Site not available",
+			Message:  "The owner of this site has asked this proxy not to forward connections to it.",
+			tlsAlert: tlsAlertAccessDenied,
+		}, true
+	case errors.Is(err, ErrPortNotAllowed):
+		return errorPage{
+			Status:   http.StatusForbidden,
+			Title:    "Port not allowed",
+			Message:  "The owner of this site does not allow connections to this port through this proxy.",
+			tlsAlert: tlsAlertAccessDenied,
+		}, true
+	case errors.Is(err, ErrSNIRequired):
+		return errorPage{
+			Status:   http.StatusForbidden,
+			Title:    "TLS required",
+			Message:  "The owner of this site only allows encrypted (TLS) connections through this proxy.",
+			tlsAlert: tlsAlertAccessDenied,
+		}, true
+	case errors.Is(err, ErrNoHost):
+		return errorPage{
+			Status:   http.StatusMisdirectedRequest,
+			Title:    "Unknown site",
+			Message:  "Your request did not say which site it was for, so this proxy does not know where to send it.",
+			tlsAlert: tlsAlertUnrecognizedName,
+		}, true
+	case errors.Is(err, ErrNoV6Addr), errors.Is(err, ErrNoCandidates):
+		return errorPage{
+			Status:   http.StatusMisdirectedRequest,
+			Title:    "No IPv6 address",
+			Message:  "This site does not have an IPv6 (AAAA) address, so this proxy has nowhere to send your request.",
+			tlsAlert: tlsAlertUnrecognizedName,
+		}, true
+	case errors.Is(err, ErrBackendBusy):
+		return errorPage{
+			Status:   http.StatusServiceUnavailable,
+			Title:    "Backend busy",
+			Message:  "This site already has as many connections through this proxy as it is allowed. Please try again later.",
+			tlsAlert: tlsAlertHandshakeFailure,
+		}, true
+	case errors.Is(err, ErrBackendUnreachable):
+		return errorPage{
+			Status:   http.StatusBadGateway,
+			Title:    "Backend unreachable",
+			Message:  "This proxy could not connect to the site over IPv6.",
+			tlsAlert: tlsAlertHandshakeFailure,
+		}, true
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return errorPage{
+			Status:    http.StatusMisdirectedRequest,
+			Title:     "No IPv6 address",
+			Message:   "The IPv6 address for this site could not be looked up.",
+			tlsAlert:  tlsAlertUnrecognizedName,
+			temporary: !dnsErr.IsNotFound,
+		}, true
+	}
+
+	return errorPage{}, false
+}
+
+func (p errorPage) httpResponse() ([]byte, error) {
+	var body bytes.Buffer
+	err := templates.ExecuteTemplate(&body, "http_error.html", p)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp bytes.Buffer
+	fmt.Fprintf(&resp, "HTTP/1.1 %d %s\r\n", p.Status, http.StatusText(p.Status))
+	fmt.Fprintf(&resp, "Content-Type: text/html; charset=utf-8\r\n")
+	fmt.Fprintf(&resp, "Content-Length: %d\r\n", body.Len())
+	fmt.Fprintf(&resp, "Connection: close\r\n")
+	fmt.Fprintf(&resp, "\r\n")
+	resp.Write(body.Bytes())
+	return resp.Bytes(), nil
+}
+
+// a reply to the RCPT command. Server errors are worth retrying, the rest
+// aren't.
+func (p errorPage) smtpReply() []byte {
+	code := 550
+	if p.temporary || p.Status >= 500 {
+		code = 451
+	}
+	return []byte(fmt.Sprintf("%d %s: %s\r\n", code, p.Title, p.Message))
+}
+
+// 421 is the only FTP reply that closes the connection
+func (p errorPage) ftpReply() []byte {
+	return []byte(fmt.Sprintf("421 %s: %s\r\n", p.Title, p.Message))
+}
+
+// a fatal alert record. Clients accept TLS 1.0 as the record version before
+// a version has been negotiated.
+func (p errorPage) tlsAlertRecord() []byte {
+	return []byte{0x15, 0x03, 0x01, 0x00, 0x02, 2, p.tlsAlert}
+}
+
+// ReplyError tells the client why we couldn't connect them, if we can do
+// that in a protocol they speak. opening is whatever the client sent us
+// before things went wrong.
+func (c *Conn) ReplyError(opening []byte, err error) {
+	page, ok := explainError(err)
+	if !ok {
+		return
+	}
+
+	port := c.LocalAddr().(*net.TCPAddr).Port
+	var reply []byte
+	id := IdentifyProtocol(opening, uint(port))
+	switch {
+	case id.name == "http":
+		page.Port = port
+		page.Zone = strings.TrimSuffix(Conf.DNSZone, ".")
+		if len(c.hosts) > 0 {
+			page.Host = c.hosts[0]
+		}
+		reply, err = page.httpResponse()
+		if err != nil {
+			c.Log("error building error page:", err)
+			return
+		}
+		c.Log("replying with HTTP", page.Status)
+	case usedSNI(id, opening):
+		// this includes protocols that were upgraded with STARTTLS
+		reply = page.tlsAlertRecord()
+		c.Log("replying with TLS alert", page.tlsAlert)
+	case id.name == "smtp":
+		if errors.Is(err, ErrNoHost) {
+			// we had a RCPT domain, but none of its MX records were usable
+			page.Title = "No IPv6 mail server"
+			page.Message = "None of the mail servers for this domain have an IPv6 address, so this proxy has nowhere to send your mail."
+		}
+		reply = page.smtpReply()
+		c.Log("replying with SMTP", string(reply[:3]))
+	case id.name == "ftp":
+		reply = page.ftpReply()
+		c.Log("replying with FTP 421")
+	default:
+		return
+	}
+
+	err = c.writeFinal(reply)
+	if err != nil {
+		c.Log("error sending error reply:", err)
+	}
+}
+
+// send the last thing we have to say to the client, then give it a chance
+// to read it before we close
+func (c *Conn) writeFinal(reply []byte) error {
+	c.SetWriteDeadline(time.Now().Add(Conf.MaxIdentifyTime.Duration))
+	_, err := c.Write(reply)
+	if err != nil {
+		return err
+	}
+
+	// if we close with unread data the kernel sends a reset, which can
+	// make the client discard our reply. Give it a moment to read it.
+	c.CloseWrite()
+	c.SetReadDeadline(time.Now().Add(Conf.MaxIdentifyTime.Duration))
+	io.Copy(io.Discard, c.TCPConn)
+	return nil
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const FTPPort = 21
+
+var ErrNoFTPDataPort = errors.New("every FTP passive port is in use")
+
+// how long a client has to open the data connection after we tell it where
+const ftpDataTimeout = 30 * time.Second
+
+// the commands a client might start with
+var rFTPIdentifier = regexp.MustCompile(`(?i)^(?:USER|HOST|FEAT|SYST|AUTH|OPTS|NOOP|QUIT)(?: |\r?\n)`)
+
+// the port in a 229 reply (RFC 2428). The delimiter is usually |.
+var rFTPEPSVReply = regexp.MustCompile(`^229 .*\([!-~]{3}(\d+)[!-~]\)`)
+
+// the port in a 227 reply. We ignore the address, since an IPv6 backend
+// can't give us a useful one.
+var rFTPPASVReply = regexp.MustCompile(`^227 .*?\d+,\d+,\d+,\d+,(\d+),(\d+)`)
+
+// FTP, based on USER user@host or HOST host (RFC 7151). We answer the
+// client until it says which host it wants, then log in to the backend for
+// it. Passive mode data connections are proxied through a port we open just
+// for that transfer.
+type ftpIdentifier struct{}
+
+func init() {
+	RegisterIdentifier("ftp", ftpIdentifier{})
+}
+
+func (ftpIdentifier) Ports() []uint {
+	return []uint{FTPPort}
+}
+
+func (ftpIdentifier) Match(b []byte) float64 {
+	if rFTPIdentifier.Match(b) {
+		return 1
+	}
+	return 0
+}
+
+// what we know about an FTP session up to the command that tells us the host
+type ftpSession struct {
+	host string
+	// if the host came from USER, the user name without it. Otherwise the
+	// host came from HOST.
+	user string
+	// the offset of the line with the host, or -1 if we haven't seen one
+	hostLine int
+	// the offset just past the last line we answered
+	answered int
+}
+
+// readFTPSession goes through the client's commands in b. reply (which may
+// be nil) is called with our reply to each command and the offset just past
+// the line it answers. We stop once we know the host.
+func readFTPSession(b []byte, reply func(reply string, end int) error) (s ftpSession, err error) {
+	s.hostLine = -1
+	for s.hostLine == -1 {
+		line, end, ok := nextLine(b, s.answered)
+		if !ok {
+			return s, nil
+		}
+		r, quitErr := s.command(line)
+		if s.host != "" {
+			s.hostLine = s.answered
+			if s.user != "" {
+				// the backend answers USER
+				return s, nil
+			}
+		}
+		if reply != nil {
+			err = reply(r, end)
+			if err != nil {
+				return s, err
+			}
+		}
+		s.answered = end
+		if quitErr != nil {
+			return s, quitErr
+		}
+	}
+	return s, nil
+}
+
+// update the session for a command line and return our reply
+func (s *ftpSession) command(line string) (reply string, err error) {
+	cmd, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+
+	switch strings.ToUpper(cmd) {
+	case "USER":
+		i := strings.LastIndexByte(arg, '@')
+		if i == -1 {
+			return "530 Log in as USER name@host so this proxy knows where to send you\r\n", nil
+		}
+		s.user = arg[:i]
+		s.host = stripPort(arg[i+1:])
+		return "", nil
+	case "HOST":
+		if arg == "" {
+			return "501 Syntax: HOST host\r\n", nil
+		}
+		s.host = stripPort(arg)
+		return "220 Host accepted\r\n", nil
+	case "FEAT":
+		return "211-Features:\r\n HOST\r\n211 End\r\n", nil
+	case "SYST":
+		return "215 UNIX Type: L8\r\n", nil
+	case "OPTS":
+		if strings.EqualFold(arg, "UTF8 ON") {
+			return "200 OK\r\n", nil
+		}
+		return "501 Option not supported\r\n", nil
+	case "NOOP":
+		return "200 OK\r\n", nil
+	case "QUIT":
+		return "221 Bye\r\n", ErrClientQuit
+	case "AUTH":
+		// we need to read the control connection to proxy data
+		// connections
+		return "502 TLS is not supported through this proxy\r\n", nil
+	default:
+		return "530 Log in as USER name@host so this proxy knows where to send you\r\n", nil
+	}
+}
+
+func (ftpIdentifier) NeedMore(b []byte) bool {
+	s, _ := readFTPSession(b, nil)
+	return s.hostLine == -1
+}
+
+func (ftpIdentifier) Hosts(b []byte, log func(...interface{})) []string {
+	s, _ := readFTPSession(b, nil)
+	if s.host == "" {
+		log("no USER name@host or HOST command")
+		return nil
+	}
+	return []string{s.host}
+}
+
+func (ftpIdentifier) Greet(client io.Writer) (n int, err error) {
+	return fmt.Fprintf(client,
+		"220 %s this is an IPv4 to IPv6 reverse proxy. Log in as USER name@host\r\n",
+		strings.TrimSuffix(Conf.DNSZone, "."),
+	)
+}
+
+func (ftpIdentifier) Respond(client io.Writer, b []byte, answered int) (int, error) {
+	s, err := readFTPSession(b, func(reply string, end int) error {
+		if end <= answered {
+			// we already sent this one
+			return nil
+		}
+		_, err := io.WriteString(client, reply)
+		return err
+	})
+	return s.answered, err
+}
+
+// read one reply, which may span several lines, and return its code
+func readFTPReply(r io.Reader) (code int, err error) {
+	line, err := readLine(r)
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 4 {
+		return 0, fmt.Errorf("unexpected FTP reply: %s", line)
+	}
+	code, err = strconv.Atoi(line[:3])
+	if err != nil {
+		return 0, fmt.Errorf("unexpected FTP reply: %s", line)
+	}
+	if line[3] == '-' {
+		// the reply ends with a line starting with the same code and a
+		// space. The lines in between can be anything.
+		for !strings.HasPrefix(line, line[:3]+" ") {
+			line, err = readLine(r)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return code, nil
+}
+
+// eat the backend's greeting, then send it whichever of USER or HOST told us
+// the host. The backend answers USER itself.
+func (ftpIdentifier) Replay(backend io.ReadWriter, b []byte) ([]byte, error) {
+	s, _ := readFTPSession(b, nil)
+
+	for {
+		code, err := readFTPReply(backend)
+		if err != nil {
+			return nil, err
+		}
+		if code == 220 {
+			break
+		}
+		if code/100 != 1 {
+			return nil, fmt.Errorf("unexpected FTP greeting: %d", code)
+		}
+		// ex: 120 Service ready in nnn minutes
+	}
+
+	if s.user != "" {
+		_, err := fmt.Fprintf(backend, "USER %s\r\n", s.user)
+		if err != nil {
+			return nil, err
+		}
+		_, end, _ := nextLine(b, s.hostLine)
+		return b[end:], nil
+	}
+	if s.host != "" {
+		_, err := fmt.Fprintf(backend, "HOST %s\r\n", s.host)
+		if err != nil {
+			return nil, err
+		}
+		// we already said yes. If the backend doesn't know HOST, it's
+		// probably the only site on its address anyway.
+		_, err = readFTPReply(backend)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b[s.answered:], nil
+}
+
+// lockedWriter lets two goroutines write whole lines to the same connection
+type lockedWriter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	return w.w.Write(p)
+}
+
+// connectFTP is like Connect, but it reads the control connection line by
+// line so it can proxy passive mode data connections. PASV is sent to the
+// backend as EPSV, since PASV can't describe an IPv6 address.
+func (c *Conn) connectFTP(backendConn *net.TCPConn, preview []byte, deadline time.Time) {
+	clientReader := bufio.NewReader(io.MultiReader(
+		bytes.NewReader(preview),
+		idleReader{c.TCPConn, Conf.ClientIdleTimeout.Duration, deadline, &c.activity},
+	))
+	clientWriter := &lockedWriter{w: shapedWriter{
+		idleWriter{c.TCPConn, Conf.BackendIdleTimeout.Duration, deadline, &c.activity},
+		c,
+		&c.bytesToClient,
+	}}
+	backendReader := bufio.NewReader(idleReader{
+		backendConn,
+		Conf.BackendIdleTimeout.Duration,
+		deadline,
+		&c.activity,
+	})
+	backendWriter := shapedWriter{
+		idleWriter{backendConn, Conf.ClientIdleTimeout.Duration, deadline, &c.activity},
+		c,
+		&c.bytesToBackend,
+	}
+	backendIP := backendConn.RemoteAddr().(*net.TCPAddr).IP
+
+	// whether the client asked for PASV rather than EPSV
+	var wantPASV atomic.Bool
+	var wg, data sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		var err error
+		for {
+			var line string
+			line, err = clientReader.ReadString('\n')
+			if err != nil {
+				break
+			}
+			cmd, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+			switch strings.ToUpper(cmd) {
+			case "PORT", "EPRT":
+				_, err = io.WriteString(clientWriter, "502 Active mode is not supported through this proxy, use passive mode\r\n")
+			case "AUTH":
+				_, err = io.WriteString(clientWriter, "502 TLS is not supported through this proxy\r\n")
+			case "PASV":
+				wantPASV.Store(true)
+				_, err = io.WriteString(backendWriter, "EPSV\r\n")
+			case "EPSV":
+				wantPASV.Store(false)
+				_, err = io.WriteString(backendWriter, line)
+			default:
+				_, err = io.WriteString(backendWriter, line)
+			}
+			if err != nil {
+				break
+			}
+		}
+		if err == io.EOF {
+			err = nil
+		}
+		c.Log("finished forwarding FTP commands:", closeReason(
+			"backend", "client", Conf.ClientIdleTimeout.Duration, deadline, err,
+		))
+		backendConn.CloseWrite()
+		if err != nil {
+			c.sockets.closeAll()
+		}
+		wg.Done()
+	}()
+	go func() {
+		var err error
+		for {
+			var line string
+			line, err = backendReader.ReadString('\n')
+			if err != nil {
+				break
+			}
+			if strings.HasPrefix(line, "227 ") || strings.HasPrefix(line, "229 ") {
+				line = c.ftpPassiveReply(line, backendIP, wantPASV.Load(), &data)
+			}
+			_, err = io.WriteString(clientWriter, line)
+			if err != nil {
+				break
+			}
+		}
+		if err == io.EOF {
+			err = nil
+		}
+		c.Log("finished forwarding FTP replies:", closeReason(
+			"client", "backend", Conf.BackendIdleTimeout.Duration, deadline, err,
+		))
+		c.CloseWrite()
+		if err != nil {
+			c.sockets.closeAll()
+		}
+		wg.Done()
+	}()
+
+	wg.Wait()
+	// let transfers that are still going finish
+	data.Wait()
+
+	c.Log("closing backend connection")
+	backendConn.Close()
+	c.recordTraffic()
+
+	// this is self-logging
+	c.Close()
+}
+
+// open a port for the data connection the backend is offering and rewrite
+// its passive mode reply to point there. If anything goes wrong the client
+// gets an error instead.
+func (c *Conn) ftpPassiveReply(
+	line string,
+	backendIP net.IP,
+	wantPASV bool,
+	data *sync.WaitGroup,
+) string {
+	port := ftpPassivePort(line)
+	if port == 0 {
+		c.Log("can't parse passive mode reply:", strings.TrimSpace(line))
+		return "425 Can't open data connection\r\n"
+	}
+	backendAddr := &net.TCPAddr{IP: backendIP, Port: port}
+
+	listener, err := listenFTPData()
+	if err != nil {
+		c.Log("error opening port for FTP data connection:", err)
+		return "425 Can't open data connection\r\n"
+	}
+	listener.SetDeadline(time.Now().Add(ftpDataTimeout))
+	publicAddr := listener.Addr().(*net.TCPAddr)
+	c.Log("proxying FTP data connection from", publicAddr, "to", backendAddr)
+
+	data.Add(1)
+	go func() {
+		defer data.Done()
+		c.ftpData(listener, backendAddr)
+	}()
+
+	return ftpPassiveReplyFor(publicAddr, wantPASV)
+}
+
+// the data port in a 227 or 229 reply, or 0 if there isn't a valid one
+func ftpPassivePort(line string) int {
+	var port int
+	if matches := rFTPEPSVReply.FindStringSubmatch(line); matches != nil {
+		port, _ = strconv.Atoi(matches[1])
+	} else if matches := rFTPPASVReply.FindStringSubmatch(line); matches != nil {
+		p1, _ := strconv.Atoi(matches[1])
+		p2, _ := strconv.Atoi(matches[2])
+		if p1 > 255 || p2 > 255 {
+			return 0
+		}
+		port = p1<<8 | p2
+	}
+	if port <= 0 || port > 65535 {
+		return 0
+	}
+	return port
+}
+
+// a passive mode reply pointing the client at addr. PASV clients get a 227,
+// even though the backend gave us a 229.
+func ftpPassiveReplyFor(addr *net.TCPAddr, wantPASV bool) string {
+	if wantPASV {
+		ip := addr.IP.To4()
+		return fmt.Sprintf(
+			"227 Entering Passive Mode (%d,%d,%d,%d,%d,%d)\r\n",
+			ip[0], ip[1], ip[2], ip[3],
+			addr.Port>>8, addr.Port&0xff,
+		)
+	}
+	return fmt.Sprintf("229 Entering Extended Passive Mode (|||%d|)\r\n", addr.Port)
+}
+
+var ftpPassivePorts struct {
+	sync.Once
+	first, last int
+}
+
+// listen on a free port in FTPPassivePorts. uvhost-netsetup.sh doesn't send
+// these ports to the proxy listener, so clients can reach us here directly.
+func listenFTPData() (*net.TCPListener, error) {
+	ftpPassivePorts.Do(func() {
+		ranges, err := parsePortRanges(Conf.FTPPassivePorts)
+		if err != nil || len(ranges) != 1 {
+			panic(fmt.Sprint("FTPPassivePorts should be a single range: ", Conf.FTPPassivePorts))
+		}
+		ftpPassivePorts.first = ranges[0].first
+		ftpPassivePorts.last = ranges[0].last
+	})
+
+	// start somewhere random so ports aren't reused right away
+	first, last := ftpPassivePorts.first, ftpPassivePorts.last
+	size := last - first + 1
+	start := rand.IntN(size)
+	ip := net.ParseIP(Conf.PublicIPv4Addr)
+	for i := range size {
+		port := first + (start+i)%size
+		listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: ip, Port: port})
+		if errors.Is(err, syscall.EADDRINUSE) {
+			continue
+		}
+		return listener, err
+	}
+	return nil, ErrNoFTPDataPort
+}
+
+// wait for the client to open the data connection, then connect it to the
+// backend
+func (c *Conn) ftpData(listener *net.TCPListener, backendAddr *net.TCPAddr) {
+	clientIP := c.RemoteAddr().(*net.TCPAddr).IP
+	// if the control connection came through a trusted load balancer, the
+	// data connection may come through it too
+	peerIP := c.TCPConn.RemoteAddr().(*net.TCPAddr).IP
+	var clientConn *net.TCPConn
+	for clientConn == nil {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			c.Log("no FTP data connection:", err)
+			listener.Close()
+			return
+		}
+		// otherwise anyone could grab the transfer (RFC 2577 section 5)
+		ip := conn.RemoteAddr().(*net.TCPAddr).IP
+		if !ip.Equal(clientIP) && !ip.Equal(peerIP) {
+			c.Log("rejecting FTP data connection from", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		clientConn = conn
+	}
+	listener.Close()
+	c.sockets.add(clientConn)
+	defer clientConn.Close()
+
+	// data connections count against the backend's limits like any other
+	slot, err := BackendLimits.Admit(backendAddr.IP)
+	if err != nil {
+		c.Log("not dialing FTP data connection:", err)
+		return
+	}
+	defer slot.Release()
+
+	// the backend should see the client, not the load balancer
+	localAddr := mappedAddrFor(&net.TCPAddr{
+		IP:   clientIP,
+		Port: clientConn.RemoteAddr().(*net.TCPAddr).Port,
+	})
+	dialer := &net.Dialer{
+		Timeout:   Conf.MaxConnectTime.Duration,
+		LocalAddr: localAddr,
+		KeepAlive: Conf.TCPKeepAlive.Duration,
+		Control:   reuseAddr,
+	}
+	conn, err := dialer.Dial("tcp6", backendAddr.String())
+	if err != nil {
+		c.Log("error dialing FTP data connection:", err)
+		return
+	}
+	backendConn := conn.(*net.TCPConn)
+	c.sockets.add(backendConn)
+	defer backendConn.Close()
+
+	deadline := c.sessionDeadline()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		bytes, reason, _ := pipe(
+			backendConn, clientConn,
+			"backend", "client",
+			Conf.ClientIdleTimeout.Duration,
+			deadline,
+			slot,
+			&c.activity,
+		)
+		c.bytesToBackend.Add(bytes)
+		c.Log("FTP data connection sent", bytes, "bytes from client:", reason)
+		backendConn.CloseWrite()
+		wg.Done()
+	}()
+	go func() {
+		bytes, reason, _ := pipe(
+			clientConn, backendConn,
+			"client", "backend",
+			Conf.BackendIdleTimeout.Duration,
+			deadline,
+			slot,
+			&c.activity,
+		)
+		c.bytesToClient.Add(bytes)
+		c.Log("FTP data connection sent", bytes, "bytes from backend:", reason)
+		clientConn.CloseWrite()
+		wg.Done()
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestReadFTPSession(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		replies  string
+		host     string
+		user     string
+		hostLine int
+		err      error
+	}{
+		{"USER with host", "USER bob@site.example\r\nPASS x\r\n", "", "site.example", "bob", 0, nil},
+		{"USER with host and port", "USER bob@site.example:21\r\n", "", "site.example", "bob", 0, nil},
+		{"USER with @ in the name", "USER bob@corp.example@site.example\r\n", "", "site.example", "bob@corp.example", 0, nil},
+		{"USER after FEAT", "FEAT\r\nUSER bob@site.example\r\n", "211-Features:\r\n HOST\r\n211 End\r\n", "site.example", "bob", 6, nil},
+		{"HOST", "HOST site.example\r\nUSER bob\r\n", "220 Host accepted\r\n", "site.example", "", 0, nil},
+		{"HOST without a host", "HOST\r\n", "501 Syntax: HOST host\r\n", "", "", -1, nil},
+		{"USER without a host", "USER bob\r\n", "530 Log in as USER name@host so this proxy knows where to send you\r\n", "", "", -1, nil},
+		{"AUTH", "AUTH TLS\r\n", "502 TLS is not supported through this proxy\r\n", "", "", -1, nil},
+		{"incomplete line", "USER bob@site", "", "", "", -1, nil},
+		{"QUIT", "QUIT\r\nUSER bob@site.example\r\n", "221 Bye\r\n", "", "", -1, ErrClientQuit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var replies bytes.Buffer
+			s, err := readFTPSession([]byte(tt.in), func(reply string, end int) error {
+				replies.WriteString(reply)
+				return nil
+			})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if replies.String() != tt.replies {
+				t.Errorf("replies = %q, want %q", replies.String(), tt.replies)
+			}
+			if s.host != tt.host {
+				t.Errorf("host = %q, want %q", s.host, tt.host)
+			}
+			if s.user != tt.user {
+				t.Errorf("user = %q, want %q", s.user, tt.user)
+			}
+			if s.hostLine != tt.hostLine {
+				t.Errorf("hostLine = %d, want %d", s.hostLine, tt.hostLine)
+			}
+		})
+	}
+}
+
+func TestFTPRespond(t *testing.T) {
+	in := []byte("SYST\r\nHOST site.example\r\nUSER bob\r\n")
+	tests := []struct {
+		name     string
+		answered int
+		out      string
+		end      int
+	}{
+		{"nothing answered yet", 0, "215 UNIX Type: L8\r\n220 Host accepted\r\n", 25},
+		{"SYST already answered", 6, "220 Host accepted\r\n", 25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			end, err := ftpIdentifier{}.Respond(&out, in, tt.answered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.out {
+				t.Errorf("wrote %q, want %q", out.String(), tt.out)
+			}
+			if end != tt.end {
+				t.Errorf("answered = %d, want %d", end, tt.end)
+			}
+		})
+	}
+}
+
+func TestFTPReplay(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend string
+		in      string
+		sent    string
+		rest    string
+		wantErr bool
+	}{
+		{"USER", "220 hi\r\n", "USER bob@site.example\r\nPASS x\r\n", "USER bob\r\n", "PASS x\r\n", false},
+		{"HOST", "220 hi\r\n220 ok\r\n", "HOST site.example\r\nUSER bob\r\n", "HOST site.example\r\n", "USER bob\r\n", false},
+		{"multiline greeting", "220-hi\r\n there\r\n220 hi\r\n", "USER bob@site.example\r\n", "USER bob\r\n", "", false},
+		{"wait then greeting", "120 soon\r\n220 hi\r\n", "USER bob@site.example\r\n", "USER bob\r\n", "", false},
+		{"busy", "421 go away\r\n", "USER bob@site.example\r\n", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &scriptedBackend{Reader: bytes.NewBufferString(tt.backend)}
+			rest, err := ftpIdentifier{}.Replay(backend, []byte(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if backend.sent.String() != tt.sent {
+				t.Errorf("sent %q, want %q", backend.sent.String(), tt.sent)
+			}
+			if err == nil && string(rest) != tt.rest {
+				t.Errorf("rest = %q, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func TestFTPPassivePort(t *testing.T) {
+	tests := []struct {
+		line string
+		port int
+	}{
+		{"229 Entering Extended Passive Mode (|||6446|)\r\n", 6446},
+		{"229 Entering Extended Passive Mode (!!!6446!)\r\n", 6446},
+		{"227 Entering Passive Mode (10,0,0,1,25,46)\r\n", 6446},
+		{"227 Entering Passive Mode 10,0,0,1,25,46\r\n", 6446},
+		{"229 Entering Extended Passive Mode (|||0|)\r\n", 0},
+		{"229 Entering Extended Passive Mode (|||70000|)\r\n", 0},
+		{"227 Entering Passive Mode (10,0,0,1,256,1)\r\n", 0},
+		{"227 Entering Passive Mode\r\n", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			if port := ftpPassivePort(tt.line); port != tt.port {
+				t.Errorf("port = %d, want %d", port, tt.port)
+			}
+		})
+	}
+}
+
+func TestFTPPassiveReplyFor(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("203.0.113.5"), Port: 50001}
+	tests := []struct {
+		name     string
+		wantPASV bool
+		reply    string
+	}{
+		{"PASV", true, "227 Entering Passive Mode (203,0,113,5,195,81)\r\n"},
+		{"EPSV", false, "229 Entering Extended Passive Mode (|||50001|)\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if reply := ftpPassiveReplyFor(addr, tt.wantPASV); reply != tt.reply {
+				t.Errorf("reply = %q, want %q", reply, tt.reply)
+			}
+		})
+	}
+}
@@ -10,6 +10,7 @@ require (
 	github.com/nursik/go-expire-map v1.2.0
 	github.com/vburenin/nsync v0.0.0-20160822015540-9a75d1c80410
 	golang.org/x/net v0.41.0
+	golang.org/x/sys v0.33.0
 	modernc.org/sqlite v1.38.0
 )
 
@@ -22,7 +23,7 @@ require (
 	golang.org/x/exp v0.0.0-20250620022241-b7579e27df2b // indirect
 	golang.org/x/mod v0.25.0 // indirect
 	golang.org/x/sync v0.15.0 // indirect
-	golang.org/x/sys v0.33.0 // indirect
+	golang.org/x/text v0.26.0 // indirect
 	golang.org/x/tools v0.34.0 // indirect
 	modernc.org/libc v1.66.0 // indirect
 	modernc.org/mathutil v1.7.1 // indirect
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// HTTP/2 with prior knowledge (h2c), based on the :authority pseudo-header
+// in the first HEADERS frame. This is mostly cleartext gRPC.
+type h2cIdentifier struct{}
+
+func init() {
+	RegisterIdentifier("h2c", h2cIdentifier{})
+}
+
+var h2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+const (
+	h2FrameHeaderLen    = 9
+	h2FrameHeaders      = 0x1
+	h2FrameContinuation = 0x9
+	h2FlagEndHeaders    = 0x4
+	h2FlagPadded        = 0x8
+	h2FlagPriority      = 0x20
+	// default SETTINGS_HEADER_TABLE_SIZE. We only decode the first header
+	// block, so the client can't have shrunk it yet.
+	h2HeaderTableSize = 4096
+)
+
+func (h2cIdentifier) Match(b []byte) float64 {
+	if bytes.HasPrefix(b, h2Preface) {
+		return 1
+	}
+	return 0
+}
+
+// returns the HPACK encoded header block of the first HEADERS frame
+// (including any CONTINUATION frames), or nil if we don't have all of it yet.
+// If the frames are malformed, ok will be false.
+func h2FirstHeaderBlock(b []byte) (block []byte, ok bool) {
+	b = b[len(h2Preface):]
+	inHeaders := false
+	for {
+		if len(b) < h2FrameHeaderLen {
+			return nil, true
+		}
+		length := int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+		frameType := b[3]
+		flags := b[4]
+		if len(b) < h2FrameHeaderLen+length {
+			return nil, true
+		}
+		payload := b[h2FrameHeaderLen : h2FrameHeaderLen+length]
+		b = b[h2FrameHeaderLen+length:]
+
+		switch {
+		case !inHeaders && frameType == h2FrameHeaders:
+			inHeaders = true
+			if flags&h2FlagPadded != 0 {
+				if len(payload) < 1 {
+					return nil, false
+				}
+				padding := int(payload[0])
+				payload = payload[1:]
+				if padding > len(payload) {
+					return nil, false
+				}
+				payload = payload[:len(payload)-padding]
+			}
+			if flags&h2FlagPriority != 0 {
+				// stream dependency (4 bytes) and weight (1 byte)
+				if len(payload) < 5 {
+					return nil, false
+				}
+				payload = payload[5:]
+			}
+		case inHeaders && frameType == h2FrameContinuation:
+		case inHeaders:
+			// nothing is allowed between HEADERS and CONTINUATION
+			return nil, false
+		default:
+			// SETTINGS, WINDOW_UPDATE, etc.
+			continue
+		}
+
+		block = append(block, payload...)
+		if flags&h2FlagEndHeaders != 0 {
+			return block, true
+		}
+	}
+}
+
+func (h2cIdentifier) NeedMore(b []byte) bool {
+	block, ok := h2FirstHeaderBlock(b)
+	return ok && block == nil
+}
+
+func (h2cIdentifier) Hosts(b []byte, log func(...interface{})) []string {
+	block, ok := h2FirstHeaderBlock(b)
+	if !ok {
+		log("malformed HTTP/2 frames")
+		return nil
+	}
+
+	decoder := hpack.NewDecoder(h2HeaderTableSize, nil)
+	decoder.SetMaxStringLength(len(block))
+	fields, err := decoder.DecodeFull(block)
+	if err != nil {
+		log("error decoding HTTP/2 headers:", err)
+		return nil
+	}
+
+	// :authority is preferred, but a host header is allowed instead
+	var host string
+	for _, field := range fields {
+		switch strings.ToLower(field.Name) {
+		case ":authority":
+			host = field.Value
+		case "host":
+			if host == "" {
+				host = field.Value
+			}
+		}
+	}
+	if host == "" {
+		log("no :authority in HTTP/2 headers")
+		return nil
+	}
+	return []string{stripPort(host)}
+}
+
+// remove the port (if any) from an authority like "example.com:8080" or
+// "[2001:db8::1]:443"
+func stripPort(authority string) string {
+	host, _, err := net.SplitHostPort(authority)
+	if err != nil {
+		// no port
+		return strings.TrimSuffix(strings.TrimPrefix(authority, "["), "]")
+	}
+	return host
+}
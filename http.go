@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var ErrHTTPMalformed = errors.New("malformed HTTP request head")
+var ErrHTTPAmbiguousHost = errors.New("HTTP request has more than one host")
+
+var rHTTPIdentifier = regexp.MustCompile(`(?i)^[A-Z]{2,15} [!-~]+ HTTP/1\.[0-9]\r?\n`)
+var rHTTPToken = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// the scheme of an absolute URI (RFC 3986 section 3.1)
+var rURIScheme = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9+.-]*$`)
+
+// a uri-host with an optional port (RFC 3986 section 3.2.2)
+var rHTTPHost = regexp.MustCompile(`^(?:\[[0-9A-Fa-f:.]+\]|[A-Za-z0-9._~!$&'()*+;=%-]+)(?::[0-9]*)?$`)
+
+type httpHeader struct {
+	Name  string
+	Value string
+}
+
+// HTTPRequestHead is the request line and header fields of an HTTP/1.x
+// request (RFC 9112).
+type HTTPRequestHead struct {
+	Method  string
+	Target  string
+	Version string
+	Headers []httpHeader
+	// number of bytes up to and including the blank line at the end of the
+	// head, or 0 if we don't have the whole head yet
+	Length int
+}
+
+// ParseHTTPRequestHead parses the request head at the start of b. If b does
+// not contain the whole head yet, Length will be 0 and err will be nil.
+func ParseHTTPRequestHead(b []byte) (head HTTPRequestHead, err error) {
+	pos := 0
+	// returns the next line without its line ending, or ok=false if there
+	// are no more complete lines
+	nextLine := func() (line string, ok bool) {
+		end := bytes.IndexByte(b[pos:], '\n')
+		if end == -1 {
+			return "", false
+		}
+		line = string(b[pos : pos+end])
+		pos += end + 1
+		// a bare LF is allowed as a line terminator (RFC 9112 section 2.2)
+		return strings.TrimSuffix(line, "\r"), true
+	}
+
+	requestLine, ok := nextLine()
+	if !ok {
+		return head, nil
+	}
+	parts := strings.Split(requestLine, " ")
+	if len(parts) != 3 || !rHTTPToken.MatchString(parts[0]) ||
+		parts[1] == "" || !strings.HasPrefix(parts[2], "HTTP/1.") {
+		return head, ErrHTTPMalformed
+	}
+	head.Method, head.Target, head.Version = parts[0], parts[1], parts[2]
+
+	for {
+		line, ok := nextLine()
+		if !ok {
+			return head, nil
+		}
+		if line == "" {
+			head.Length = pos
+			return head, nil
+		}
+
+		// obsolete line folding could be used to hide a header from us
+		if line[0] == ' ' || line[0] == '\t' {
+			return head, ErrHTTPMalformed
+		}
+		name, value, found := strings.Cut(line, ":")
+		// whitespace between the name and colon is forbidden (RFC 9112
+		// section 5.1) for the same reason
+		if !found || !rHTTPToken.MatchString(name) {
+			return head, ErrHTTPMalformed
+		}
+		head.Headers = append(head.Headers, httpHeader{
+			Name:  name,
+			Value: strings.Trim(value, " \t"),
+		})
+	}
+}
+
+// Host returns the host the request is for, without a port. Per RFC 9112
+// section 3.2.2 the request target takes precedence over the Host header.
+// An empty host with a nil error means the client didn't say.
+func (head HTTPRequestHead) Host() (string, error) {
+	// any HTTP/1.1 request with multiple Host headers must be rejected.
+	// Different servers pick different ones, which is a smuggling risk.
+	var hostHeaders []string
+	for _, header := range head.Headers {
+		if strings.EqualFold(header.Name, "Host") {
+			hostHeaders = append(hostHeaders, header.Value)
+		}
+	}
+	if len(hostHeaders) > 1 {
+		return "", ErrHTTPAmbiguousHost
+	}
+
+	switch {
+	case isAbsoluteForm(head.Target):
+		u, err := url.Parse(head.Target)
+		if err != nil || u.Host == "" {
+			return "", ErrHTTPMalformed
+		}
+		return u.Hostname(), nil
+	case strings.EqualFold(head.Method, "CONNECT"):
+		// authority-form
+		if !rHTTPHost.MatchString(head.Target) {
+			return "", ErrHTTPMalformed
+		}
+		return stripPort(head.Target), nil
+	case len(hostHeaders) == 0 || hostHeaders[0] == "":
+		return "", nil
+	case !rHTTPHost.MatchString(hostHeaders[0]):
+		return "", ErrHTTPMalformed
+	default:
+		return stripPort(hostHeaders[0]), nil
+	}
+}
+
+// whether the (maybe incomplete) head says which host it is for yet
+func (head HTTPRequestHead) hasHost() bool {
+	if isAbsoluteForm(head.Target) || strings.EqualFold(head.Method, "CONNECT") {
+		return true
+	}
+	for _, header := range head.Headers {
+		if strings.EqualFold(header.Name, "Host") {
+			return true
+		}
+	}
+	return false
+}
+
+// origin-form targets start with a slash, and may contain a URL in their
+// query string. absolute-form targets start with a scheme.
+func isAbsoluteForm(target string) bool {
+	scheme, _, found := strings.Cut(target, "://")
+	return found && rURIScheme.MatchString(scheme)
+}
+
+// HTTP, based on the request target or host header
+type httpIdentifier struct{}
+
+func init() {
+	RegisterIdentifier("http", httpIdentifier{})
+}
+
+func (httpIdentifier) Match(b []byte) float64 {
+	if rHTTPIdentifier.Match(b) {
+		return 1
+	}
+	return 0
+}
+
+// we don't wait for the whole head once we know the host, since heads with
+// big cookies may not fit in MaxLookahead. Duplicate Host headers are only
+// caught if they are in the bytes we have.
+func (httpIdentifier) NeedMore(b []byte) bool {
+	head, err := ParseHTTPRequestHead(b)
+	return err == nil && head.Length == 0 && !head.hasHost()
+}
+
+func (httpIdentifier) Hosts(b []byte, log func(...interface{})) []string {
+	head, err := ParseHTTPRequestHead(b)
+	if err != nil {
+		log(err)
+		return nil
+	}
+	host, err := head.Host()
+	if err != nil {
+		log(err)
+		return nil
+	}
+	if host == "" {
+		log("no host in http request")
+		return nil
+	}
+	return []string{host}
+}
+
+// values in a Forwarded header must be quoted unless they are tokens (IPv6
+// addresses and host:port pairs need quotes, for example)
+func forwardedValue(s string) string {
+	if rHTTPToken.MatchString(s) {
+		return s
+	}
+	return strconv.Quote(s)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseHTTPRequestHead(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		length  int
+		headers int
+		err     error
+	}{
+		{"complete", "GET / HTTP/1.1\r\nHost: a.example\r\n\r\nbody", 35, 1, nil},
+		{"bare LF", "GET / HTTP/1.1\nHost: a.example\n\n", 32, 1, nil},
+		{"incomplete", "GET / HTTP/1.1\r\nHost: a.exa", 0, 0, nil},
+		{"no request line yet", "GET / HT", 0, 0, nil},
+		{"bad method", "G(T / HTTP/1.1\r\n\r\n", 0, 0, ErrHTTPMalformed},
+		{"extra space", "GET  / HTTP/1.1\r\n\r\n", 0, 0, ErrHTTPMalformed},
+		{"not HTTP/1", "GET / HTTP/2.0\r\n\r\n", 0, 0, ErrHTTPMalformed},
+		{"line folding", "GET / HTTP/1.1\r\nX: a\r\n b\r\n\r\n", 0, 0, ErrHTTPMalformed},
+		{"space before colon", "GET / HTTP/1.1\r\nHost : a.example\r\n\r\n", 0, 0, ErrHTTPMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			head, err := ParseHTTPRequestHead([]byte(tt.in))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if head.Length != tt.length {
+				t.Errorf("Length = %d, want %d", head.Length, tt.length)
+			}
+			if len(head.Headers) != tt.headers {
+				t.Errorf("got %d headers, want %d", len(head.Headers), tt.headers)
+			}
+		})
+	}
+}
+
+func TestHTTPRequestHeadHost(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		host string
+		err  error
+	}{
+		{"origin-form", "GET /index.html HTTP/1.1\r\nHost: good.example\r\n\r\n", "good.example", nil},
+		{"origin-form with port", "GET / HTTP/1.1\r\nHost: good.example:8080\r\n\r\n", "good.example", nil},
+		{"origin-form with URL in query", "GET /login?next=http://x/ HTTP/1.1\r\nHost: good.example\r\n\r\n", "good.example", nil},
+		{"asterisk-form", "OPTIONS * HTTP/1.1\r\nHost: good.example\r\n\r\n", "good.example", nil},
+		{"absolute-form", "GET http://abs.example/x HTTP/1.1\r\nHost: good.example\r\n\r\n", "abs.example", nil},
+		{"absolute-form with port", "GET https://abs.example:8443/ HTTP/1.1\r\n\r\n", "abs.example", nil},
+		{"absolute-form without host", "GET http:///x HTTP/1.1\r\nHost: good.example\r\n\r\n", "", ErrHTTPMalformed},
+		{"authority-form", "CONNECT conn.example:443 HTTP/1.1\r\nHost: conn.example:443\r\n\r\n", "conn.example", nil},
+		{"authority-form garbage", "CONNECT conn/example HTTP/1.1\r\n\r\n", "", ErrHTTPMalformed},
+		{"IPv6 host header", "GET / HTTP/1.1\r\nHost: [2001:db8::1]:8080\r\n\r\n", "2001:db8::1", nil},
+		{"IPv6 absolute-form", "GET http://[2001:db8::1]/ HTTP/1.1\r\n\r\n", "2001:db8::1", nil},
+		{"IPv6 authority-form", "CONNECT [2001:db8::1]:443 HTTP/1.1\r\n\r\n", "2001:db8::1", nil},
+		{"no host", "GET / HTTP/1.0\r\n\r\n", "", nil},
+		{"empty host", "GET / HTTP/1.1\r\nHost:\r\n\r\n", "", nil},
+		{"bad host", "GET / HTTP/1.1\r\nHost: a b\r\n\r\n", "", ErrHTTPMalformed},
+		{"duplicate host", "GET / HTTP/1.1\r\nHost: a.example\r\nHost: b.example\r\n\r\n", "", ErrHTTPAmbiguousHost},
+		{"duplicate host, different case", "GET / HTTP/1.1\r\nHost: a.example\r\nhOST: a.example\r\n\r\n", "", ErrHTTPAmbiguousHost},
+		{"duplicate host with absolute-form", "GET http://abs.example/ HTTP/1.1\r\nHost: a.example\r\nHost: b.example\r\n\r\n", "", ErrHTTPAmbiguousHost},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			head, err := ParseHTTPRequestHead([]byte(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			host, err := head.Host()
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if host != tt.host {
+				t.Errorf("host = %q, want %q", host, tt.host)
+			}
+		})
+	}
+}
+
+func TestHTTPNeedMore(t *testing.T) {
+	cookie := "Cookie: " + strings.Repeat("a", 20000) + "\r\n"
+	tests := []struct {
+		name     string
+		in       string
+		needMore bool
+		host     string
+	}{
+		{"complete", "GET / HTTP/1.1\r\nHost: a.example\r\n\r\n", false, "a.example"},
+		{"host then big cookie", "GET / HTTP/1.1\r\nHost: a.example\r\n" + cookie[:10000], false, "a.example"},
+		{"big cookie then host", "GET / HTTP/1.1\r\n" + cookie + "Host: a.example\r\n", false, "a.example"},
+		{"big cookie, no host yet", "GET / HTTP/1.1\r\n" + cookie[:10000], true, ""},
+		{"absolute-form", "GET http://abs.example/ HTTP/1.1\r\n", false, "abs.example"},
+		{"partial host line", "GET / HTTP/1.1\r\nHost: a.exa", true, ""},
+		{"duplicate host", "GET / HTTP/1.1\r\nHost: a.example\r\nHost: b.example\r\n", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := []byte(tt.in)
+			if got := (httpIdentifier{}).NeedMore(b); got != tt.needMore {
+				t.Fatalf("NeedMore = %v, want %v", got, tt.needMore)
+			}
+			if tt.needMore {
+				return
+			}
+			hosts := httpIdentifier{}.Hosts(b, func(...interface{}) {})
+			host := ""
+			if len(hosts) > 0 {
+				host = hosts[0]
+			}
+			if host != tt.host {
+				t.Errorf("host = %q, want %q", host, tt.host)
+			}
+		})
+	}
+}
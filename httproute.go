@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// values for the HTTPRouting config option. These control what happens when
+// a later request on a keep-alive connection is for a different vhost.
+const (
+	// pin the connection to the first vhost and splice it blindly
+	HTTPRoutingSplice = "splice"
+	// parse every request and connect to a new backend when the host changes
+	HTTPRoutingRedial = "redial"
+	// parse every request and answer 421 Misdirected Request when the host
+	// changes
+	HTTPRoutingReject = "reject"
+)
+
+func httpRoutingEnabled() bool {
+	switch Conf.HTTPRouting {
+	case HTTPRoutingRedial, HTTPRoutingReject:
+		return true
+	default:
+		return false
+	}
+}
+
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// an HTTP/1.1 backend connection along with the buffered reader we parse
+// responses from
+type httpBackend struct {
+	conn   *net.TCPConn
+	reader *bufio.Reader
+	writer io.Writer
+}
+
+func (c *Conn) newHTTPBackend(conn *net.TCPConn) (*httpBackend, error) {
+	c.sockets.add(conn)
+	setKeepAlive(conn)
+
+	deadline := c.sessionDeadline()
+	b := &httpBackend{
+		conn: conn,
+		reader: bufio.NewReader(idleReader{
+			conn,
+			Conf.BackendIdleTimeout.Duration,
+			deadline,
+			&c.activity,
+		}),
+		writer: shapedWriter{
+			idleWriter{conn, Conf.ClientIdleTimeout.Duration, deadline, &c.activity},
+			c,
+			&c.bytesToBackend,
+		},
+	}
+
+	if c.proxyHeader != nil {
+		c.Log("sending PROXY protocol header:", c.proxyHeader)
+		_, err := b.writer.Write(c.proxyHeader)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// connectHTTP is like Connect, but it parses each HTTP/1.1 request and
+// response instead of splicing bytes. This lets us notice when a keep-alive
+// connection moves on to a different vhost, add Forwarded headers to every
+// request, and log each request.
+func (c *Conn) connectHTTP(backendConn *net.TCPConn) {
+	deadline := c.sessionDeadline()
+	clientReader := bufio.NewReader(io.MultiReader(
+		bytes.NewReader(c.preview),
+		idleReader{c.TCPConn, Conf.ClientIdleTimeout.Duration, deadline, &c.activity},
+	))
+	clientWriter := shapedWriter{
+		idleWriter{c.TCPConn, Conf.BackendIdleTimeout.Duration, deadline, &c.activity},
+		c,
+		&c.bytesToClient,
+	}
+	clientIP := c.RemoteAddr().(*net.TCPAddr).IP
+
+	var backend *httpBackend
+	defer func() {
+		if backend != nil {
+			c.Log("closing backend connection")
+			backend.conn.Close()
+			c.recordTraffic()
+		}
+		// this is self-logging
+		c.Close()
+	}()
+
+	backend, err := c.newHTTPBackend(backendConn)
+	if err != nil {
+		c.Log("error writing to backend:", err)
+		return
+	}
+	currentHost := c.hosts[0]
+
+	for {
+		req, err := http.ReadRequest(clientReader)
+		if err == io.EOF {
+			c.Log("client closed the connection")
+			return
+		}
+		if err != nil {
+			c.Log("error reading request from client:", err)
+			return
+		}
+
+		host := stripPort(req.Host)
+		// if HTTPRouting is splice, we are only parsing requests to add
+		// Forwarded headers, so we stay pinned to the first vhost like a
+		// splice would
+		if !strings.EqualFold(host, currentHost) && httpRoutingEnabled() {
+			c.Log("request for", host, "on connection for", currentHost)
+			if Conf.HTTPRouting == HTTPRoutingReject {
+				c.replyPage(clientWriter, errorPage{
+					Status:  http.StatusMisdirectedRequest,
+					Title:   "Misdirected request",
+					Message: "This connection was opened for a different site. Please connect again.",
+					Host:    host,
+				})
+				c.accessLog(req, host, http.StatusMisdirectedRequest, 0)
+				return
+			}
+
+			c.Log("closing backend connection")
+			backend.conn.Close()
+			c.recordTraffic()
+			backend = nil
+			hosts, err := c.allowedHosts([]string{host})
+			var newConn *net.TCPConn
+			if err == nil {
+				newConn, err = c.dialHosts(hosts)
+			}
+			if err != nil {
+				page, ok := explainError(err)
+				if ok {
+					page.Host = host
+					c.replyPage(clientWriter, page)
+					c.accessLog(req, host, page.Status, 0)
+				}
+				return
+			}
+			backend, err = c.newHTTPBackend(newConn)
+			if err != nil {
+				c.Log("error writing to backend:", err)
+				return
+			}
+			currentHost = host
+		}
+
+		if c.forwarded {
+			forwarded := "for=" + forwardedValue(clientIP.String()) +
+				";proto=http;host=" + forwardedValue(host)
+			req.Header.Set("Forwarded", forwarded)
+			req.Header.Set("X-Forwarded-For", clientIP.String())
+		}
+		// Write sends the body right after the headers, so the backend's
+		// 100 Continue would only reach the client after the body it is
+		// waiting to send. Say it ourselves instead.
+		if expectsContinue(req) {
+			req.Header.Del("Expect")
+			if req.ContentLength != 0 {
+				_, err = io.WriteString(clientWriter, "HTTP/1.1 100 Continue\r\n\r\n")
+				if err != nil {
+					c.Log("error writing response to client:", err)
+					return
+				}
+			}
+		}
+
+		err = writeRequest(backend.writer, req)
+		if err != nil {
+			c.Log("error writing request to backend:", err)
+			return
+		}
+
+		client := &countingWriter{Writer: clientWriter}
+		var resp *http.Response
+		for {
+			resp, err = http.ReadResponse(backend.reader, req)
+			if err != nil {
+				c.Log("error reading response from backend:", err)
+				return
+			}
+			// pass along informational responses (ex: 103 Early Hints) and
+			// wait for the real one
+			if resp.StatusCode/100 != 1 || resp.StatusCode == http.StatusSwitchingProtocols {
+				break
+			}
+			err = resp.Write(client)
+			if err != nil {
+				c.Log("error writing response to client:", err)
+				return
+			}
+		}
+
+		if !req.ProtoAtLeast(1, 1) && len(resp.TransferEncoding) > 0 {
+			// the client can't read chunks, so send the body as-is and
+			// close the connection to end it
+			resp.TransferEncoding = nil
+			resp.Close = true
+		}
+		err = resp.Write(client)
+		resp.Body.Close()
+		c.accessLog(req, host, resp.StatusCode, client.n)
+		if err != nil {
+			c.Log("error writing response to client:", err)
+			return
+		}
+
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			// ex: websockets. From here on it's not HTTP anymore.
+			c.Log("protocol switched, splicing connection")
+			c.spliceHTTP(clientReader, clientWriter, backend)
+			return
+		}
+		if req.Close || resp.Close {
+			c.Log("connection: close")
+			return
+		}
+	}
+}
+
+// Request.Write always says HTTP/1.1, which lets the backend answer with a
+// chunked response that an HTTP/1.0 client can't read. Older requests go
+// out with the client's version.
+func writeRequest(w io.Writer, req *http.Request) error {
+	if req.ProtoAtLeast(1, 1) {
+		// otherwise Write adds Go's default User-Agent
+		if _, ok := req.Header["User-Agent"]; !ok {
+			req.Header["User-Agent"] = []string{""}
+		}
+		return req.Write(w)
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s %s HTTP/%d.%d\r\n",
+		req.Method, req.RequestURI, req.ProtoMajor, req.ProtoMinor)
+	// ReadRequest moves Host out of the headers
+	if req.Host != "" {
+		fmt.Fprintf(bw, "Host: %s\r\n", req.Host)
+	}
+	err := req.Header.Write(bw)
+	if err != nil {
+		return err
+	}
+	bw.WriteString("\r\n")
+	_, err = io.Copy(bw, req.Body)
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func expectsContinue(req *http.Request) bool {
+	return req.ProtoAtLeast(1, 1) &&
+		strings.EqualFold(strings.TrimSpace(req.Header.Get("Expect")), "100-continue")
+}
+
+// copy bytes both ways (including anything already buffered) until both
+// sides are done
+func (c *Conn) spliceHTTP(
+	clientReader *bufio.Reader,
+	clientWriter io.Writer,
+	backend *httpBackend,
+) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		bytes, err := io.Copy(backend.writer, clientReader)
+		c.Log("finished forwarding", bytes, "additional bytes from client:",
+			closeReason("backend", "client", Conf.ClientIdleTimeout.Duration, c.sessionDeadline(), err))
+		backend.conn.CloseWrite()
+		if err != nil {
+			c.sockets.closeAll()
+		}
+		wg.Done()
+	}()
+	go func() {
+		bytes, err := io.Copy(clientWriter, backend.reader)
+		c.Log("finished forwarding", bytes, "additional bytes from backend:",
+			closeReason("client", "backend", Conf.BackendIdleTimeout.Duration, c.sessionDeadline(), err))
+		c.CloseWrite()
+		if err != nil {
+			c.sockets.closeAll()
+		}
+		wg.Done()
+	}()
+	wg.Wait()
+}
+
+func (c *Conn) replyPage(w io.Writer, page errorPage) {
+	page.Port = c.LocalAddr().(*net.TCPAddr).Port
+	page.Zone = strings.TrimSuffix(Conf.DNSZone, ".")
+	resp, err := page.httpResponse()
+	if err != nil {
+		c.Log("error building error page:", err)
+		return
+	}
+	c.Log("replying with HTTP", page.Status)
+	_, err = w.Write(resp)
+	if err != nil {
+		c.Log("error sending error reply:", err)
+	}
+}
+
+// one line per request, in roughly the common log format
+func (c *Conn) accessLog(req *http.Request, host string, status int, bytes int64) {
+	Log(fmt.Sprintf(
+		"access: %s %s %s %q %d %d",
+		c.RemoteAddr().(*net.TCPAddr).IP,
+		host,
+		req.Method,
+		req.URL.RequestURI(),
+		status,
+		bytes,
+	))
+}
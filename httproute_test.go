@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWriteRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		out  string
+	}{
+		{
+			"HTTP/1.0 keeps its version",
+			"POST /x HTTP/1.0\r\nHost: a.example\r\nContent-Length: 3\r\n\r\nabc",
+			"POST /x HTTP/1.0\r\nHost: a.example\r\nContent-Length: 3\r\n\r\nabc",
+		},
+		{
+			"HTTP/1.0 absolute-form",
+			"GET http://a.example/ HTTP/1.0\r\n\r\n",
+			"GET http://a.example/ HTTP/1.0\r\nHost: a.example\r\n\r\n",
+		},
+		{
+			"HTTP/1.1 without User-Agent",
+			"GET / HTTP/1.1\r\nHost: a.example\r\n\r\n",
+			"GET / HTTP/1.1\r\nHost: a.example\r\n\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(tt.in)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			err = writeRequest(&out, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.out {
+				t.Errorf("wrote %q, want %q", out.String(), tt.out)
+			}
+		})
+	}
+}
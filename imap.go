@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+const IMAPPort = 143
+
+// a tag followed by a command
+var rIMAPIdentifier = regexp.MustCompile(`^[!-~]+ [A-Za-z]+(?: |\r?\n)`)
+
+// what we tell clients we can do. LOGINDISABLED keeps well behaved clients
+// from sending a password before STARTTLS.
+const imapCapabilities = "IMAP4rev1 STARTTLS LOGINDISABLED"
+
+// IMAP, based on the SNI in the ClientHello after STARTTLS. We answer the
+// client's commands until it starts TLS, then ask the backend to start TLS
+// too and splice them together.
+type imapIdentifier struct{}
+
+func init() {
+	RegisterIdentifier("imap", imapIdentifier{})
+}
+
+func (imapIdentifier) Ports() []uint {
+	return []uint{IMAPPort}
+}
+
+func (imapIdentifier) Match(b []byte) float64 {
+	if rIMAPIdentifier.Match(b) {
+		return 1
+	}
+	return 0
+}
+
+func isIMAPStartTLS(line string) bool {
+	fields := strings.Fields(line)
+	return len(fields) == 2 && strings.EqualFold(fields[1], "STARTTLS")
+}
+
+func imapStartTLSEnd(b []byte) int {
+	_, end := findStartTLS(b, isIMAPStartTLS)
+	return end
+}
+
+func (imapIdentifier) NeedMore(b []byte) bool {
+	return startTLSNeedMore(b, imapStartTLSEnd(b))
+}
+
+func (imapIdentifier) Hosts(b []byte, log func(...interface{})) []string {
+	return startTLSHosts(b, imapStartTLSEnd(b), log)
+}
+
+func (imapIdentifier) UsedSNI(b []byte) bool {
+	return imapStartTLSEnd(b) != -1
+}
+
+func (imapIdentifier) Greet(client io.Writer) (n int, err error) {
+	return fmt.Fprintf(client,
+		"* OK [CAPABILITY %s] %s this is an IPv4 to IPv6 reverse proxy\r\n",
+		imapCapabilities,
+		strings.TrimSuffix(Conf.DNSZone, "."),
+	)
+}
+
+// the reply to a single command line. upgrade is true if the client should
+// start TLS next.
+func imapReply(line string) (reply string, upgrade bool, err error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "* BAD empty command\r\n", false, nil
+	}
+	tag := fields[0]
+	if len(fields) == 1 {
+		return tag + " BAD missing command\r\n", false, nil
+	}
+
+	switch strings.ToUpper(fields[1]) {
+	case "CAPABILITY":
+		return "* CAPABILITY " + imapCapabilities + "\r\n" +
+			tag + " OK CAPABILITY completed\r\n", false, nil
+	case "NOOP":
+		return tag + " OK NOOP completed\r\n", false, nil
+	case "ID":
+		// RFC 2971. Some clients send this before logging in.
+		return "* ID NIL\r\n" + tag + " OK ID completed\r\n", false, nil
+	case "STARTTLS":
+		if !isIMAPStartTLS(line) {
+			return tag + " BAD STARTTLS takes no arguments\r\n", false, nil
+		}
+		return tag + " OK Begin TLS negotiation now\r\n", true, nil
+	case "LOGOUT":
+		return "* BYE logging out\r\n" + tag + " OK LOGOUT completed\r\n", false, ErrClientQuit
+	default:
+		return tag + " BAD this proxy needs STARTTLS to know where to send you\r\n", false, nil
+	}
+}
+
+func (imapIdentifier) Respond(client io.Writer, b []byte, answered int) (int, error) {
+	return startTLSRespond(client, b, answered, imapReply, isIMAPStartTLS)
+}
+
+// ask the backend to start TLS. The client's other commands were only
+// there to get to STARTTLS, so we don't bother replaying them.
+func (imapIdentifier) Replay(backend io.ReadWriter, b []byte) ([]byte, error) {
+	startTLS, end := findStartTLS(b, isIMAPStartTLS)
+	if end == -1 {
+		// ex: a default backend for clients that never sent STARTTLS
+		return b, nil
+	}
+
+	greeting, err := readLine(backend)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting, "* OK") {
+		return nil, fmt.Errorf("unexpected IMAP greeting: %s", greeting)
+	}
+
+	// use the client's tag, just in case
+	tag := strings.Fields(startTLS)[0]
+	_, err = fmt.Fprintf(backend, "%s STARTTLS\r\n", tag)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		line, err := readLine(backend)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(line, "* ") {
+			// untagged responses don't matter
+			continue
+		}
+		if !strings.HasPrefix(strings.ToUpper(line), strings.ToUpper(tag)+" OK") {
+			return nil, fmt.Errorf("backend refused STARTTLS: %s", line)
+		}
+		return b[end:], nil
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// a backend that says its lines and records what we send it
+type scriptedBackend struct {
+	io.Reader
+	sent bytes.Buffer
+}
+
+func (s *scriptedBackend) Write(b []byte) (int, error) {
+	return s.sent.Write(b)
+}
+
+func TestIMAPReplay(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend string
+		in      string
+		sent    string
+		rest    string
+		wantErr bool
+	}{
+		{"starttls", "* OK ready\r\na1 OK go\r\n", "a1 CAPABILITY\r\na1 STARTTLS\r\n\x16\x03\x01", "a1 STARTTLS\r\n", "\x16\x03\x01", false},
+		{"untagged before ok", "* OK ready\r\n* CAPABILITY IMAP4rev1\r\nx OK go\r\n", "x starttls\r\n", "x STARTTLS\r\n", "", false},
+		{"no starttls", "* OK ready\r\n", "\x16\x03\x01\x02\x00", "", "\x16\x03\x01\x02\x00", false},
+		{"no starttls, empty", "", "", "", "", false},
+		{"refused", "* OK ready\r\na1 NO not today\r\n", "a1 STARTTLS\r\n", "a1 STARTTLS\r\n", "", true},
+		{"bad greeting", "220 smtp.example\r\n", "a1 STARTTLS\r\n", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &scriptedBackend{Reader: bytes.NewBufferString(tt.backend)}
+			rest, err := imapIdentifier{}.Replay(backend, []byte(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if backend.sent.String() != tt.sent {
+				t.Errorf("sent %q, want %q", backend.sent.String(), tt.sent)
+			}
+			if err == nil && string(rest) != tt.rest {
+				t.Errorf("rest = %q, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
 	_ "embed"
+	"errors"
+	"expvar"
 	"net"
 	"net/http"
 
@@ -18,12 +21,16 @@ func (h staticHTML) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 //go:embed README.md
 var readmeMD []byte
 
+var readmeHTML = markdown.ToHTML(readmeMD, nil, nil)
+
 func ServeInfo(tf *TableFlip) {
-	readmeHTML := markdown.ToHTML(readmeMD, nil, nil)
 	mux := http.NewServeMux()
 	mux.Handle("/", staticHTML(readmeHTML))
 	mux.Handle("/abuseipdb-verification.html", staticHTML([]byte(Conf.AbuseIPDBVerification)))
-	mux.Handle("/abuse", http.HandlerFunc(handleAbuseUI))
+	mux.Handle("/abuse", requireAuth(handleAbuseUI))
+	mux.Handle("/traffic", requireAuth(handleTrafficUI))
+	mux.Handle("/negative-cache", requireAuth(handleNegativeCacheUI))
+	mux.Handle("/debug/vars", requireAuth(expvar.Handler().ServeHTTP))
 	mux.Handle("/hpd/", http.HandlerFunc(handleHPD))
 
 	listenAddr := net.JoinHostPort(Conf.PublicIPv6Addr, "http")
@@ -31,8 +38,18 @@ func ServeInfo(tf *TableFlip) {
 	if err != nil {
 		panic(err)
 	}
-	err = http.Serve(l, mux)
-	if err != nil {
+	server := &http.Server{Handler: mux}
+	tf.OnExit(func() {
+		// stop accepting now, but don't hold up closing the proxy listener
+		// and draining while requests finish
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), Conf.DrainTimeout.Duration)
+			defer cancel()
+			server.Shutdown(ctx)
+		}()
+	})
+	err = server.Serve(l)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		panic(err)
 	}
 }
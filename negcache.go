@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// NegativeCache remembers backends we recently failed to reach (and vhosts
+// that recently had no IPv6 address) so that repeated attempts fail fast
+// instead of each waiting out MaxConnectTime. Each consecutive failure
+// doubles how long we remember it for, from NegativeCacheMin up to
+// NegativeCacheMax.
+var NegativeCache = &negativeCache{entries: make(map[string]*negativeEntry)}
+
+type negativeCache struct {
+	sync.Mutex
+	entries map[string]*negativeEntry
+}
+
+type negativeEntry struct {
+	err      error
+	failures int
+	until    time.Time
+}
+
+func dialCacheKey(addr *net.TCPAddr) string {
+	return "dial " + addr.String()
+}
+
+// backends may filter by client (our mapped source address), so some
+// failures are only remembered for the client that saw them
+func clientDialCacheKey(src net.IP, addr *net.TCPAddr) string {
+	return "dial " + src.String() + " -> " + addr.String()
+}
+
+func lookupCacheKey(host string) string {
+	return "lookup " + host
+}
+
+// only lookup failures that say something about the vhost are worth
+// remembering. Timeouts and SERVFAIL could be our resolver's fault.
+func cacheableLookupErr(err error) bool {
+	if errors.Is(err, ErrNoV6Addr) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// the key to remember a dial failure under, or false if it isn't worth
+// remembering. Unreachable networks say something about the backend, so
+// everyone fails fast. A refusal or timeout could be a firewall rule for
+// just this client, so only this client fails fast; otherwise one client
+// could get a backend cut off for everybody. Errors like EADDRINUSE are
+// about our side and aren't remembered at all.
+func dialFailureKey(src net.IP, addr *net.TCPAddr, err error) (string, bool) {
+	if errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.ENETUNREACH) {
+		return dialCacheKey(addr), true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ETIMEDOUT) {
+		return clientDialCacheKey(src, addr), true
+	}
+	// the dial timed out, as opposed to being cancelled because another
+	// attempt won
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return clientDialCacheKey(src, addr), true
+	}
+	return "", false
+}
+
+// Check returns the cached failure for key, or nil if we should try.
+func (n *negativeCache) Check(key string) error {
+	n.Lock()
+	defer n.Unlock()
+	e, ok := n.entries[key]
+	if !ok || time.Now().After(e.until) {
+		return nil
+	}
+	return e.err
+}
+
+// Fail records a failure, backing off exponentially if key failed recently.
+func (n *negativeCache) Fail(key string, err error) {
+	if Conf.NegativeCacheMin.Duration <= 0 {
+		return
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	now := time.Now()
+	n.sweep(now)
+
+	e, ok := n.entries[key]
+	if !ok {
+		e = new(negativeEntry)
+		n.entries[key] = e
+	}
+	e.err = err
+	e.failures++
+
+	backoff := Conf.NegativeCacheMin.Duration
+	for i := 1; i < e.failures && backoff < Conf.NegativeCacheMax.Duration; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, Conf.NegativeCacheMax.Duration)
+	e.until = now.Add(backoff)
+}
+
+// Succeed forgets about key's failures.
+func (n *negativeCache) Succeed(key string) {
+	n.Lock()
+	defer n.Unlock()
+	delete(n.entries, key)
+}
+
+// Clear forgets about key, or everything if key is empty.
+func (n *negativeCache) Clear(key string) {
+	n.Lock()
+	defer n.Unlock()
+	if key == "" {
+		n.entries = make(map[string]*negativeEntry)
+		return
+	}
+	delete(n.entries, key)
+}
+
+// forget entries that expired long enough ago that the next failure should
+// start the backoff over. The caller must hold the lock.
+func (n *negativeCache) sweep(now time.Time) {
+	for key, e := range n.entries {
+		if now.Sub(e.until) > Conf.NegativeCacheMax.Duration {
+			delete(n.entries, key)
+		}
+	}
+}
+
+// handleNegativeCacheUI shows what is in the negative cache and lets us
+// clear entries (ex: after a backend owner says they fixed something).
+func handleNegativeCacheUI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		NegativeCache.Clear(r.FormValue("key"))
+		http.Redirect(w, r, "/negative-cache", http.StatusSeeOther)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type entry struct {
+		Key      string
+		Reason   string
+		Failures int
+		Until    string
+		Active   bool
+	}
+	var entries []entry
+
+	NegativeCache.Lock()
+	now := time.Now()
+	NegativeCache.sweep(now)
+	for key, e := range NegativeCache.entries {
+		entries = append(entries, entry{
+			Key:      key,
+			Reason:   e.err.Error(),
+			Failures: e.failures,
+			Until:    e.until.Format("2006-01-02 03:04:05 PM"),
+			Active:   now.Before(e.until),
+		})
+	}
+	NegativeCache.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	err := templates.ExecuteTemplate(w, "negative_cache.html", entries)
+	if err != nil {
+		Log("Error executing template:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
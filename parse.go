@@ -1,105 +1,219 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
 )
 
-var rHTTPIdentifier = regexp.MustCompile(`(?i)^[A-Z]{2,15} /[!-~]* HTTP/[0-9]+\.[0-9]+\r?\n`)
-var rHTTPHostHeader = regexp.MustCompile(`(?i)^HOST: ?([^:]+)(?::[0-9]+)?$`)
-var rTLSIdentifier = regexp.MustCompile(`^\x16\x03[\x00-\x06]`)
-var rSMTPIdentifier = regexp.MustCompile(`(?i)^(?:HELO|EHLO) `)
-var rSMTPRCPTCommand = regexp.MustCompile(`(?i)\nRCPT TO: *(?:<[!-~]+@([!-~]+)>|[!-~]+@([!-~]+)) *\r?\n`)
 var rGenericIdentifier = regexp.MustCompile(`(?i)(?:[0-9a-f]{4}-){7}[0-9a-f]{4}\.` +
 	regexp.QuoteMeta(strings.TrimSuffix(Conf.DNSZone, ".")))
 
-// attempt to identify the host based on what we have so far. Ex:
-//     HOST        FINISHED
-// -------------- ----------
-// "example.com"   true       The vhost is example.com. Parsing need not continue.
-// nil             false      There is not enough information available to identify the vhost yet. Parsing should continue in the next round.
-// nil             true       The vhost could not be identified. There is no hope of identification in future rounds. Parsing can stop.
-// "example.com"   false      undefined
-func Parse(b []byte, portHint uint, log func(...interface{})) (hosts []string, finished bool) {
-	log("attempting to identify vhost based on", len(b), "bytes")
+// Identifier knows how to find the vhost in the opening bytes of a single
+// protocol. Implementations register themselves with RegisterIdentifier from
+// an init() function.
+type Identifier interface {
+	// Match returns how confident we are (0 to 1) that b is the start of
+	// this protocol. 0 means "definitely not" or "can't tell yet".
+	Match(b []byte) float64
+	// NeedMore reports whether more bytes are needed before Hosts can give
+	// a final answer.
+	NeedMore(b []byte) bool
+	// Hosts returns the vhosts the client wants, in order of preference.
+	// An empty result means the vhost can not be identified.
+	Hosts(b []byte, log func(...interface{})) []string
+}
+
+// PortHinter can optionally be implemented by an Identifier to restrict it
+// to specific (local) ports.
+type PortHinter interface {
+	Ports() []uint
+}
+
+// Greeter can optionally be implemented by an Identifier for protocols where
+// the server speaks first. Greet is called before we read anything from the
+// client on one of the identifier's ports.
+type Greeter interface {
+	PortHinter
+	Greet(client io.Writer) (n int, err error)
+}
+
+// Responder can optionally be implemented by a Greeter for protocols where
+// we have to answer the client's commands ourselves before it says which
+// vhost it wants. Respond is called each time more bytes arrive. It should
+// answer any complete commands in b[answered:] and return the offset of the
+// first byte it has not answered.
+type Responder interface {
+	Respond(client io.Writer, b []byte, answered int) (int, error)
+}
+
+// Replayer can optionally be implemented by a Greeter. It is given the
+// backend connection before anything else is sent to it, and should play the
+// client's side of the exchange we faked (reading the backend's replies as
+// it goes). It returns the part of b that should be passed along as-is. Ex:
+// anything after STARTTLS, which servers throw away if it arrives before
+// they say to go ahead. If the backend refuses something the client thinks
+// we already accepted, Replay returns a *BackendReplyError.
+type Replayer interface {
+	Replay(backend io.ReadWriter, b []byte) (rest []byte, err error)
+}
 
-	if portHint == SMTPPort && rSMTPIdentifier.Match(b) {
-		// SMTP based on host part of TO address
-		log("protocol: smtp")
+// BackendReplyError holds a reply from the backend that should be passed on
+// to the client as-is, so it sees the real reason its session failed.
+type BackendReplyError struct {
+	Reply []byte
+}
 
-		matches := rSMTPRCPTCommand.FindStringSubmatch(string(b))
-		if matches == nil {
-			// we are not to the RCPT command yet
-			return nil, false
+func (e *BackendReplyError) Error() string {
+	return fmt.Sprintf("backend replied: %q", e.Reply)
+}
+
+// SNIReporter can optionally be implemented by an Identifier that sometimes
+// gets the vhost from a TLS ClientHello (ex: after STARTTLS).
+type SNIReporter interface {
+	UsedSNI(b []byte) bool
+}
+
+// used when the Identifiers config option is empty
+var DefaultIdentifiers = []string{"smtp", "submission", "imap", "pop3", "ftp", "http", "h2c", "tls", "generic"}
+
+var identifierRegistry = make(map[string]Identifier)
+
+type namedIdentifier struct {
+	name string
+	Identifier
+}
+
+var enabledIdentifiers struct {
+	sync.Once
+	list []namedIdentifier
+}
+
+func RegisterIdentifier(name string, id Identifier) {
+	if _, exists := identifierRegistry[name]; exists {
+		panic("identifier registered twice: " + name)
+	}
+	identifierRegistry[name] = id
+}
+
+// EnabledIdentifiers returns identifiers in the order given by the
+// Identifiers config option.
+func EnabledIdentifiers() []namedIdentifier {
+	enabledIdentifiers.Do(func() {
+		names := Conf.Identifiers
+		if len(names) == 0 {
+			names = DefaultIdentifiers
+		}
+		for _, name := range names {
+			id, exists := identifierRegistry[name]
+			if !exists {
+				panic(fmt.Sprintf("unknown identifier %q", name))
+			}
+			enabledIdentifiers.list = append(
+				enabledIdentifiers.list,
+				namedIdentifier{name, id},
+			)
 		}
+	})
+	return enabledIdentifiers.list
+}
 
-		var rcptDomain string
-		if len(matches[1]) > 0 {
-			rcptDomain = matches[1]
-		} else if len(matches[2]) > 0 {
-			rcptDomain = matches[2]
-		} else {
-			log("empty domain in RCPT command")
-			return nil, true
+// identifiers without port hints apply to every port
+func identifierAppliesToPort(id Identifier, port uint) bool {
+	hinter, ok := id.(PortHinter)
+	if !ok {
+		return true
+	}
+	return slices.Contains(hinter.Ports(), port)
+}
+
+// GreeterForPort returns the first enabled Greeter for the given port, or
+// nil if clients on that port are expected to speak first.
+func GreeterForPort(port uint) Greeter {
+	for _, id := range EnabledIdentifiers() {
+		greeter, ok := id.Identifier.(Greeter)
+		if ok && identifierAppliesToPort(id.Identifier, port) {
+			return greeter
 		}
+	}
+	return nil
+}
+
+// usedSNI reports whether id got the vhost in b from a TLS ClientHello.
+func usedSNI(id namedIdentifier, b []byte) bool {
+	if _, ok := id.Identifier.(tlsIdentifier); ok {
+		return true
+	}
+	reporter, ok := id.Identifier.(SNIReporter)
+	return ok && reporter.UsedSNI(b)
+}
 
-		// spec says we should prefer MX records but fall back to A/AAAA
-		hosts, err := IPv6LookupMX(rcptDomain)
-		if err != nil {
-			log("error looking up MX records:", err)
+// IdentifyProtocol returns the identifier most confident that it
+// understands b. Ties go to whichever comes first in the config. If nothing
+// matches, the result has a nil Identifier.
+func IdentifyProtocol(b []byte, portHint uint) namedIdentifier {
+	var best namedIdentifier
+	var bestScore float64
+	for _, id := range EnabledIdentifiers() {
+		if !identifierAppliesToPort(id.Identifier, portHint) {
+			continue
 		}
-		if len(hosts) == 0 {
-			log("no suitable MX records; falling back to AAAA")
-			hosts = []string{rcptDomain}
+		score := id.Match(b)
+		if score > bestScore {
+			best = id
+			bestScore = score
 		}
-		return hosts, true
-
-	} else if rHTTPIdentifier.Match(b) {
-		// HTTP, based on host header
-		log("protocol: http")
-
-		headers := strings.Split(string(b), "\r\n")
-		for _, header := range headers {
-			// a blank line is how HTTP signals the end of headers
-			if header == "" {
-				log("end of http headers before HOST header")
-				return nil, true
-			}
+	}
+	return best
+}
 
-			matches := rHTTPHostHeader.FindStringSubmatch(header)
-			if len(matches) == 2 {
-				host := matches[1]
-				return []string{host}, true
-			}
-		}
+// attempt to identify the host based on what we have so far. Ex:
+//     HOST        FINISHED
+// -------------- ----------
+// "example.com"   true       The vhost is example.com. Parsing need not continue.
+// nil             false      There is not enough information available to identify the vhost yet. Parsing should continue in the next round.
+// nil             true       The vhost could not be identified. There is no hope of identification in future rounds. Parsing can stop.
+// "example.com"   false      undefined
+func Parse(b []byte, portHint uint, log func(...interface{})) (hosts []string, finished bool) {
+	log("attempting to identify vhost based on", len(b), "bytes")
 
-		// need mode data
+	best := IdentifyProtocol(b, portHint)
+	if best.Identifier == nil {
+		log("protocol: no match")
 		return nil, false
-	} else if rTLSIdentifier.Match(b) {
-		// TLS, based on SNI
-		log("protocol: tls")
-
-		tlsInfo, err := ReadClientHello(b)
-		if err == nil {
-			if tlsInfo.ServerName != "" {
-				host := tlsInfo.ServerName
-				return []string{host}, true
-			} else {
-				log("no SNI information")
-				return nil, true
-			}
-		}
+	}
+	log("protocol:", best.name)
 
-		// need mode data
+	if best.NeedMore(b) {
 		return nil, false
-	} else if match := rGenericIdentifier.Find(b); match != nil {
-		// generic string search (does not work with cnames)
-		log("protocol: generic")
+	}
+	return best.Hosts(b, log), true
+}
+
+// generic string search (does not work with cnames)
+type genericIdentifier struct{}
+
+func init() {
+	RegisterIdentifier("generic", genericIdentifier{})
+}
 
-		host := string(match)
-		return []string{host}, true
+// a hostname anywhere in the data is a pretty weak signal, so anything more
+// specific should win.
+func (genericIdentifier) Match(b []byte) float64 {
+	if rGenericIdentifier.Match(b) {
+		return 0.1
 	}
+	return 0
+}
+
+func (genericIdentifier) NeedMore(b []byte) bool {
+	return false
+}
 
-	log("protocol: no match")
-	return nil, false
+func (genericIdentifier) Hosts(b []byte, log func(...interface{})) []string {
+	host := string(rGenericIdentifier.Find(b))
+	return []string{host}
 }
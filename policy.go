@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	expiremap "github.com/nursik/go-expire-map"
+)
+
+var ErrBackendOptedOut = errors.New("backend owner opted out of the proxy")
+var ErrPortNotAllowed = errors.New("backend owner does not allow this port")
+var ErrSNIRequired = errors.New("backend owner requires TLS with SNI")
+
+var policyCache = expiremap.New() // used by LookupBackendPolicy()
+
+// BackendPolicy is how a backend owner tells us how to treat their traffic.
+// It comes from a TXT record at _uvhost.<vhost> (or, if there isn't one,
+// _uvhost.<ipv6-address>.<DNSZone>) containing space separated key=value
+// pairs. Ex:
+//
+//	_uvhost.example.com. TXT "proxy=v2 ports=80,443 abuse=25"
+type BackendPolicy struct {
+	// don't proxy anything for this vhost
+	OptOut bool
+	// if not empty, the only ports we will proxy
+	Ports []portRange
+	// the port to dial on the backend, by the port the client connected to.
+	// Only the owner of the IPv6 address gets to set this, otherwise any
+	// vhost could point us at any port on someone else's server.
+	PortMap map[int]int
+	// block clients at or above this abuse confidence. This can only be
+	// stricter than AbuseConfidenceThreshold. 0 for the proxy's default.
+	AbuseThreshold int
+	// only proxy TLS connections (including STARTTLS), where we got the
+	// vhost from SNI
+	RequireSNI bool
+	// 0 for none, otherwise the HAProxy PROXY protocol version to send
+	ProxyProtocol int
+	// add Forwarded and X-Forwarded-For headers to plain HTTP requests
+	Forwarded bool
+}
+
+type portRange struct {
+	first, last int
+}
+
+// parse a boolean policy value. A key with no value means on.
+func parsePolicyBool(value string) (b bool, ok bool) {
+	switch strings.ToLower(value) {
+	case "", "on", "yes", "1", "required":
+		return true, true
+	case "off", "no", "0":
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+// "80,443,8000-8099"
+func parsePortRanges(value string) ([]portRange, error) {
+	var ranges []portRange
+	for _, part := range strings.Split(value, ",") {
+		firstStr, lastStr, isRange := strings.Cut(part, "-")
+		if !isRange {
+			lastStr = firstStr
+		}
+		first, err := strconv.ParseUint(firstStr, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		last, err := strconv.ParseUint(lastStr, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		if last < first {
+			return nil, fmt.Errorf("backwards port range: %s", part)
+		}
+		ranges = append(ranges, portRange{int(first), int(last)})
+	}
+	return ranges, nil
+}
+
+// "443:8443,80:8080"
+func parsePortMap(value string) (map[int]int, error) {
+	portMap := make(map[int]int)
+	for _, part := range strings.Split(value, ",") {
+		fromStr, toStr, found := strings.Cut(part, ":")
+		if !found {
+			return nil, fmt.Errorf("expected from:to, got %s", part)
+		}
+		from, err := strconv.ParseUint(fromStr, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		to, err := strconv.ParseUint(toStr, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		portMap[int(from)] = int(to)
+	}
+	return portMap, nil
+}
+
+func parseBackendPolicy(txts []string, log func(...interface{})) BackendPolicy {
+	var p BackendPolicy
+	for _, txt := range txts {
+		for _, field := range strings.Fields(txt) {
+			key, value, _ := strings.Cut(field, "=")
+			switch strings.ToLower(key) {
+			case "optout":
+				optOut, ok := parsePolicyBool(value)
+				if !ok {
+					log("ignoring unknown optout setting:", value)
+					continue
+				}
+				p.OptOut = optOut
+			case "ports":
+				ports, err := parsePortRanges(value)
+				if err != nil {
+					log("ignoring invalid ports:", value, err)
+					continue
+				}
+				p.Ports = ports
+			case "remap":
+				portMap, err := parsePortMap(value)
+				if err != nil {
+					log("ignoring invalid port map:", value, err)
+					continue
+				}
+				p.PortMap = portMap
+			case "abuse":
+				threshold, err := strconv.Atoi(value)
+				if err != nil || threshold < 1 {
+					log("ignoring invalid abuse threshold:", value)
+					continue
+				}
+				p.AbuseThreshold = threshold
+			case "sni":
+				requireSNI, ok := parsePolicyBool(value)
+				if !ok {
+					log("ignoring unknown sni setting:", value)
+					continue
+				}
+				p.RequireSNI = requireSNI
+			case "proxy":
+				switch strings.ToLower(value) {
+				case "v1", "1":
+					p.ProxyProtocol = 1
+				case "v2", "2":
+					p.ProxyProtocol = 2
+				case "off", "none", "0":
+					p.ProxyProtocol = 0
+				default:
+					log("ignoring unknown proxy protocol version:", value)
+				}
+			case "forwarded":
+				forwarded, ok := parsePolicyBool(value)
+				if !ok {
+					log("ignoring unknown forwarded setting:", value)
+					continue
+				}
+				p.Forwarded = forwarded
+			default:
+				log("ignoring unknown policy key:", key)
+			}
+		}
+	}
+	return p
+}
+
+// AllowsPort reports whether the policy lets us proxy connections to port.
+func (p BackendPolicy) AllowsPort(port int) bool {
+	if len(p.Ports) == 0 {
+		return true
+	}
+	for _, r := range p.Ports {
+		if r.first <= port && port <= r.last {
+			return true
+		}
+	}
+	return false
+}
+
+// BackendPort is the port to dial on the backend when a client connects to
+// port.
+func (p BackendPolicy) BackendPort(port int) int {
+	backendPort, ok := p.PortMap[port]
+	if !ok {
+		return port
+	}
+	return backendPort
+}
+
+// Check returns an error if the policy doesn't let us proxy c.
+func (p BackendPolicy) Check(c *Conn) error {
+	port := c.LocalAddr().(*net.TCPAddr).Port
+	switch {
+	case p.OptOut:
+		return ErrBackendOptedOut
+	case !p.AllowsPort(port):
+		return ErrPortNotAllowed
+	case p.RequireSNI && !c.sni:
+		return ErrSNIRequired
+	case p.AbuseThreshold > 0 && c.abuseConfidence >= p.AbuseThreshold:
+		return ErrAbuseBlocked
+	}
+	return nil
+}
+
+// allowedHosts returns the hosts whose owners let us proxy c. If there are
+// none, the error says why the last one didn't.
+func (c *Conn) allowedHosts(hosts []string) ([]string, error) {
+	var allowed []string
+	var lastErr error
+	for _, host := range hosts {
+		err := LookupBackendPolicy(host, c.Log).Check(c)
+		if err != nil {
+			c.Log("policy for", host, "refused connection:", err)
+			lastErr = err
+			continue
+		}
+		allowed = append(allowed, host)
+	}
+	if len(allowed) == 0 {
+		return nil, lastErr
+	}
+	return allowed, nil
+}
+
+// LookupBackendPolicy fetches the policy for a vhost, from the cache if we
+// can. A missing record is not an error, it just means the default policy.
+// Neither is a failed lookup, but that result isn't cached.
+func LookupBackendPolicy(host string, log func(...interface{})) BackendPolicy {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	cached, ok := policyCache.Get(host)
+	if ok {
+		return cached.(BackendPolicy)
+	}
+
+	// whether txts came from the owner of the IPv6 address
+	ip := IPv6Extract(host + ".")
+	fromAddr := ip != nil && IPv6Name(ip) == host+"."
+	txts, ttl, err := lookupPolicyTXT("_uvhost." + host + ".")
+	if err == nil && txts == nil && !fromAddr {
+		// let the owner of the IPv6 address set a policy for every vhost
+		// that points at it
+		ipName := ipv6NameFor(host)
+		if ipName != "" && ipName != host+"." {
+			var ipTTL time.Duration
+			txts, ipTTL, err = lookupPolicyTXT("_uvhost." + ipName)
+			ttl = min(ttl, ipTTL)
+			fromAddr = true
+		}
+	}
+	if err != nil {
+		// use the default policy for this connection, but don't remember
+		// it, so the next connection tries again
+		log("error looking up backend policy for", host+":", err)
+		return BackendPolicy{}
+	}
+
+	var p BackendPolicy
+	if txts != nil {
+		log("backend policy for", host+":", txts)
+		p = parseBackendPolicy(txts, log)
+		if p.PortMap != nil && !fromAddr {
+			log("ignoring remap for", host+": only the record for its IPv6 address can remap ports")
+			p.PortMap = nil
+		}
+	}
+	policyCache.Set(host, p, ttl)
+	return p
+}
+
+// the <ipv6-address>.<DNSZone> name for host's backend, or "" if we can't
+// find one
+func ipv6NameFor(host string) string {
+	ip := IPv6Extract(host + ".")
+	if ip == nil {
+		ips, err := IPv6Lookup(host)
+		if err != nil || len(ips) == 0 {
+			return ""
+		}
+		ip = ips[0]
+	}
+	return IPv6Name(ip)
+}
+
+// look up TXT records using RecurseServer so we get a TTL. A name with no
+// TXT records returns nil txts and a nil error. The TTL is clamped to
+// RecurseMinTTL and RecurseMaxTTL.
+func lookupPolicyTXT(name string) (txts []string, ttl time.Duration, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), Conf.MaxLookupTime.Duration)
+	defer cancel()
+
+	query := new(dns.Msg)
+	query.SetQuestion(name, dns.TypeTXT)
+	query.RecursionDesired = true
+
+	resp, _, err := (&dns.Client{Net: "udp"}).ExchangeContext(ctx, query, Conf.RecurseServer+":53")
+	if err == nil && resp.Truncated {
+		resp, _, err = (&dns.Client{Net: "tcp"}).ExchangeContext(ctx, query, Conf.RecurseServer+":53")
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, 0, fmt.Errorf("%s looking up %s", dns.RcodeToString[resp.Rcode], name)
+	}
+
+	minTTL := Conf.RecurseMaxTTL
+	for _, record := range resp.Answer {
+		// this may include CNAMEs on the way to the TXT records
+		minTTL = min(minTTL, record.Header().Ttl)
+		if txt, isTXT := record.(*dns.TXT); isTXT {
+			// the passthrough may hand back several records as the strings
+			// of one, so keep them apart
+			txts = append(txts, strings.Join(txt.Txt, " "))
+		}
+	}
+	if txts == nil {
+		// negative answers are cached for the SOA's minimum TTL
+		// (RFC 2308 section 5). Without an SOA (ex: the empty answers
+		// our own passthrough gives) we don't know how long "no policy"
+		// is good for, so we check again soon.
+		hasSOA := false
+		for _, record := range resp.Ns {
+			if soa, isSOA := record.(*dns.SOA); isSOA {
+				minTTL = min(minTTL, soa.Hdr.Ttl, soa.Minttl)
+				hasSOA = true
+			}
+		}
+		if !hasSOA {
+			minTTL = Conf.RecurseMinTTL
+		}
+	}
+	minTTL = max(minTTL, Conf.RecurseMinTTL)
+
+	return txts, time.Duration(minTTL) * time.Second, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+const POP3Port = 110
+
+// a command from RFC 1939 or RFC 2449 that a client might send first
+var rPOP3Identifier = regexp.MustCompile(`(?i)^(?:CAPA|STLS|USER|APOP|AUTH|NOOP|QUIT)(?: |\r?\n)`)
+
+// POP3, based on the SNI in the ClientHello after STLS. This works just like
+// IMAP.
+type pop3Identifier struct{}
+
+func init() {
+	RegisterIdentifier("pop3", pop3Identifier{})
+}
+
+func (pop3Identifier) Ports() []uint {
+	return []uint{POP3Port}
+}
+
+func (pop3Identifier) Match(b []byte) float64 {
+	if rPOP3Identifier.Match(b) {
+		return 1
+	}
+	return 0
+}
+
+func isPOP3StartTLS(line string) bool {
+	return strings.EqualFold(strings.TrimSpace(line), "STLS")
+}
+
+func pop3StartTLSEnd(b []byte) int {
+	_, end := findStartTLS(b, isPOP3StartTLS)
+	return end
+}
+
+func (pop3Identifier) NeedMore(b []byte) bool {
+	return startTLSNeedMore(b, pop3StartTLSEnd(b))
+}
+
+func (pop3Identifier) Hosts(b []byte, log func(...interface{})) []string {
+	return startTLSHosts(b, pop3StartTLSEnd(b), log)
+}
+
+func (pop3Identifier) UsedSNI(b []byte) bool {
+	return pop3StartTLSEnd(b) != -1
+}
+
+func (pop3Identifier) Greet(client io.Writer) (n int, err error) {
+	return fmt.Fprintf(client,
+		"+OK %s this is an IPv4 to IPv6 reverse proxy\r\n",
+		strings.TrimSuffix(Conf.DNSZone, "."),
+	)
+}
+
+// the reply to a single command line. upgrade is true if the client should
+// start TLS next.
+func pop3Reply(line string) (reply string, upgrade bool, err error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "-ERR empty command\r\n", false, nil
+	}
+
+	switch strings.ToUpper(fields[0]) {
+	case "CAPA":
+		return "+OK Capability list follows\r\nSTLS\r\n.\r\n", false, nil
+	case "NOOP":
+		return "+OK\r\n", false, nil
+	case "STLS":
+		if !isPOP3StartTLS(line) {
+			return "-ERR STLS takes no arguments\r\n", false, nil
+		}
+		return "+OK Begin TLS negotiation now\r\n", true, nil
+	case "QUIT":
+		return "+OK bye\r\n", false, ErrClientQuit
+	default:
+		return "-ERR this proxy needs STLS to know where to send you\r\n", false, nil
+	}
+}
+
+func (pop3Identifier) Respond(client io.Writer, b []byte, answered int) (int, error) {
+	return startTLSRespond(client, b, answered, pop3Reply, isPOP3StartTLS)
+}
+
+// ask the backend to start TLS. Like with IMAP, nothing the client said
+// before STLS is worth replaying.
+func (pop3Identifier) Replay(backend io.ReadWriter, b []byte) ([]byte, error) {
+	end := pop3StartTLSEnd(b)
+	if end == -1 {
+		// ex: a default backend for clients that never sent STLS
+		return b, nil
+	}
+
+	greeting, err := readLine(backend)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting, "+OK") {
+		return nil, fmt.Errorf("unexpected POP3 greeting: %s", greeting)
+	}
+
+	_, err = io.WriteString(backend, "STLS\r\n")
+	if err != nil {
+		return nil, err
+	}
+	reply, err := readLine(backend)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(reply, "+OK") {
+		return nil, fmt.Errorf("backend refused STLS: %s", reply)
+	}
+	return b[end:], nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPOP3Replay(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend string
+		in      string
+		sent    string
+		rest    string
+		wantErr bool
+	}{
+		{"stls", "+OK ready\r\n+OK go\r\n", "CAPA\r\nSTLS\r\n\x16\x03\x01", "STLS\r\n", "\x16\x03\x01", false},
+		{"no stls", "+OK ready\r\n", "\x16\x03\x01\x02\x00", "", "\x16\x03\x01\x02\x00", false},
+		{"refused", "+OK ready\r\n-ERR not today\r\n", "STLS\r\n", "STLS\r\n", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &scriptedBackend{Reader: bytes.NewBufferString(tt.backend)}
+			rest, err := pop3Identifier{}.Replay(backend, []byte(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if backend.sent.String() != tt.sent {
+				t.Errorf("sent %q, want %q", backend.sent.String(), tt.sent)
+			}
+			if err == nil && string(rest) != tt.rest {
+				t.Errorf("rest = %q, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+)
+
+// preview buffers start this big and grow (up to MaxLookahead) as needed
+const previewInitialSize = 4096
+
+var previewPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, previewInitialSize)
+		return &b
+	},
+}
+
+func getPreviewBuffer() []byte {
+	return (*previewPool.Get().(*[]byte))[:0]
+}
+
+func putPreviewBuffer(b []byte) {
+	if b == nil {
+		return
+	}
+	b = b[:0]
+	previewPool.Put(&b)
+}
+
+func maxLookahead() int {
+	if Conf.MaxLookahead <= 0 {
+		return previewInitialSize
+	}
+	return Conf.MaxLookahead
+}
+
+// make sure there is room to read more into the preview buffer. Returns
+// false if the buffer is already MaxLookahead bytes.
+func (c *Conn) growPreview() bool {
+	if len(c.preview) >= maxLookahead() {
+		return false
+	}
+	if len(c.preview) < cap(c.preview) {
+		return true
+	}
+
+	newCap := min(2*cap(c.preview), maxLookahead())
+	grown := make([]byte, len(c.preview), newCap)
+	copy(grown, c.preview)
+	putPreviewBuffer(c.preview)
+	c.preview = grown
+	return true
+}
+
+// read whatever the client has sent into the preview buffer
+func (c *Conn) readPreview() (int, error) {
+	end := min(cap(c.preview), maxLookahead())
+	n, err := c.Read(c.preview[len(c.preview):end])
+	c.preview = c.preview[:len(c.preview)+n]
+	return n, err
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"net"
 )
 
@@ -9,19 +10,42 @@ func Proxy(tf *TableFlip) {
 	if err != nil {
 		panic(err)
 	}
+	// wait for the accept loop to stop, so every connection it accepted is
+	// in ActiveConns before we drain
+	stopped := make(chan struct{})
+	tf.OnExit(func() {
+		listener.Close()
+		<-stopped
+	})
 
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			// we are being replaced by a new process
+			close(stopped)
+			return
+		}
 		if err != nil {
 			Log(err)
 			continue
 		}
 		tcpConn := conn.(*net.TCPConn)
-		go handle(NewConn(tcpConn))
+		c := NewConn(tcpConn)
+		ActiveConns.Add(c)
+		go handle(c)
 	}
 }
 
-func handle(c Conn) {
+func handle(c *Conn) {
+	defer ActiveConns.Remove(c)
+
+	err := c.acceptProxyHeader()
+	if err != nil {
+		c.Log("error reading PROXY protocol header:", err)
+		c.Close()
+		return
+	}
+
 	if c.ClientIsIPv6() {
 		c.Log("dropping IPv6 Client:", c.RemoteAddr().String())
 		c.Close()
@@ -29,7 +53,16 @@ func handle(c Conn) {
 	}
 
 	ip := c.RemoteAddr().(*net.TCPAddr).IP
+	release, err := ClientLimits.Admit(ip)
+	if err != nil {
+		c.Log("throttling client:", err)
+		c.Close()
+		return
+	}
+	defer release()
+
 	abuseConfidence := AbuseIPDBCheck(ip, c.Log)
+	c.abuseConfidence = abuseConfidence
 
 	if abuseConfidence == ReportedByUs {
 		c.Log("AbuseIPDB abuse confidence: ReportedByUs")
@@ -39,13 +72,28 @@ func handle(c Conn) {
 
 	if abuseConfidence >= Conf.AbuseConfidenceThreshold {
 		c.Log("blocking connection because of abuse score")
-		RecordAbusiveOpen(c)
+		opening := RecordAbusiveOpen(c)
+		c.ReplyError(opening, ErrAbuseBlocked)
+		c.Close()
+		return
+	}
+
+	err = c.Identify()
+	if err != nil && c.DefaultAction(err) {
+		return
+	}
+	if err == nil {
+		err = c.CheckPolicy()
+	}
+	if err != nil {
+		c.ReplyError(c.preview, err)
 		c.Close()
 		return
 	}
 
 	backend, err := c.DialBackend()
 	if err != nil {
+		c.ReplyError(c.preview, err)
 		c.Close()
 		return
 	}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrBadProxyHeader = errors.New("invalid PROXY protocol header")
+
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV2VersionCommand = 0x21 // version 2, PROXY command
+	proxyV2TCP4           = 0x11 // TCP over IPv4
+	proxyV2TCP6           = 0x21 // TCP over IPv6
+	proxyV2TypeAuthority  = 0x02 // PP2_TYPE_AUTHORITY
+)
+
+// ProxyHeaderV1 builds a human readable PROXY protocol header describing a
+// connection from src to dst.
+func ProxyHeaderV1(src, dst *net.TCPAddr) []byte {
+	family := "TCP4"
+	srcIP, dstIP := src.IP.String(), dst.IP.String()
+	if src.IP.To4() == nil || dst.IP.To4() == nil {
+		family = "TCP6"
+		// net.IP prints IPv4-mapped addresses in dotted form, which isn't
+		// valid for TCP6
+		srcIP = netip.AddrFrom16([16]byte(src.IP.To16())).String()
+		dstIP = netip.AddrFrom16([16]byte(dst.IP.To16())).String()
+	}
+	return []byte(fmt.Sprintf(
+		"PROXY %s %s %s %d %d\r\n",
+		family,
+		srcIP,
+		dstIP,
+		src.Port,
+		dst.Port,
+	))
+}
+
+// ProxyHeaderV2 builds a binary PROXY protocol header describing a
+// connection from src to dst. If authority is not empty it is included as a
+// PP2_TYPE_AUTHORITY TLV (the same thing HAProxy uses for SNI).
+func ProxyHeaderV2(src, dst *net.TCPAddr, authority string) []byte {
+	var family byte
+	var addrs []byte
+	if src.IP.To4() != nil && dst.IP.To4() != nil {
+		family = proxyV2TCP4
+		addrs = append(addrs, src.IP.To4()...)
+		addrs = append(addrs, dst.IP.To4()...)
+	} else {
+		family = proxyV2TCP6
+		addrs = append(addrs, src.IP.To16()...)
+		addrs = append(addrs, dst.IP.To16()...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(src.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(dst.Port))
+
+	var tlvs []byte
+	if authority != "" {
+		tlvs = append(tlvs, proxyV2TypeAuthority)
+		tlvs = binary.BigEndian.AppendUint16(tlvs, uint16(len(authority)))
+		tlvs = append(tlvs, authority...)
+	}
+
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, proxyV2VersionCommand, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)+len(tlvs)))
+	header = append(header, addrs...)
+	header = append(header, tlvs...)
+	return header
+}
+
+var trustedProxies struct {
+	sync.Once
+	nets []*net.IPNet
+}
+
+// IsTrustedProxy reports whether addr is allowed to (and therefore must)
+// send us a PROXY protocol header.
+func IsTrustedProxy(addr net.Addr) bool {
+	trustedProxies.Do(func() {
+		for _, cidr := range Conf.TrustedProxyCIDRs {
+			trustedProxies.nets = append(
+				trustedProxies.nets,
+				parseCIDROrPanic(cidr),
+			)
+		}
+	})
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range trustedProxies.nets {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadProxyHeader consumes a PROXY protocol v1 or v2 header from r without
+// reading past the end of it. src and dst are nil if the header does not
+// carry addresses (v1 UNKNOWN or v2 LOCAL, typically health checks).
+func ReadProxyHeader(r io.Reader) (src, dst *net.TCPAddr, err error) {
+	start := make([]byte, 6)
+	_, err = io.ReadFull(r, start)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case string(start) == "PROXY ":
+		return readProxyHeaderV1(r)
+	case bytes.Equal(start, proxyV2Signature[:6]):
+		return readProxyHeaderV2(r, start)
+	default:
+		return nil, nil, ErrBadProxyHeader
+	}
+}
+
+// the v1 spec limits the whole line to 107 bytes
+func readProxyHeaderV1(r io.Reader) (src, dst *net.TCPAddr, err error) {
+	var line []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) > 107-len("PROXY ") {
+			return nil, nil, ErrBadProxyHeader
+		}
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 1 && fields[0] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, nil, ErrBadProxyHeader
+	}
+	srcIP := net.ParseIP(fields[1])
+	dstIP := net.ParseIP(fields[2])
+	srcPort, srcErr := strconv.ParseUint(fields[3], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[4], 10, 16)
+	if srcIP == nil || dstIP == nil || srcErr != nil || dstErr != nil {
+		return nil, nil, ErrBadProxyHeader
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)},
+		&net.TCPAddr{IP: dstIP, Port: int(dstPort)},
+		nil
+}
+
+func readProxyHeaderV2(r io.Reader, start []byte) (src, dst *net.TCPAddr, err error) {
+	header := make([]byte, 16)
+	copy(header, start)
+	_, err = io.ReadFull(r, header[len(start):])
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+		return nil, nil, ErrBadProxyHeader
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	command := header[12] & 0x0f
+	if command == 0 {
+		// LOCAL
+		return nil, nil, nil
+	}
+	if command != 1 {
+		return nil, nil, ErrBadProxyHeader
+	}
+
+	var ipLen int
+	switch header[13] {
+	case proxyV2TCP4:
+		ipLen = net.IPv4len
+	case proxyV2TCP6:
+		ipLen = net.IPv6len
+	default:
+		return nil, nil, ErrBadProxyHeader
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, ErrBadProxyHeader
+	}
+	src = &net.TCPAddr{
+		IP:   net.IP(body[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+	}
+	dst = &net.TCPAddr{
+		IP:   net.IP(body[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:])),
+	}
+	return src, dst, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrClientRateLimited = errors.New("client is opening connections too quickly")
+var ErrSubnetRateLimited = errors.New("client's /24 is opening connections too quickly")
+var ErrClientConnLimit = errors.New("client has too many open connections")
+var ErrGlobalConnLimit = errors.New("proxy has too many open connections")
+
+// counts of connections we refused, by reason. These show up on
+// /debug/vars on the info server.
+var throttledConns = expvar.NewMap("throttled_connections")
+
+// ClientLimits keeps a single client (or a single /24) from using up our
+// file descriptors or AbuseIPDB quota.
+var ClientLimits = &clientLimiter{
+	clientRate: newRateLimiter(),
+	subnetRate: newRateLimiter(),
+	open:       make(map[string]int),
+}
+
+type clientLimiter struct {
+	clientRate *rateLimiter
+	subnetRate *rateLimiter
+
+	sync.Mutex
+	open      map[string]int // by client IP
+	totalOpen int
+}
+
+func init() {
+	expvar.Publish("open_connections", expvar.Func(func() any {
+		ClientLimits.Lock()
+		defer ClientLimits.Unlock()
+		return ClientLimits.totalOpen
+	}))
+}
+
+// Admit checks whether a new connection from ip is allowed. If it is, the
+// connection counts against the concurrency limits until release is called.
+func (l *clientLimiter) Admit(ip net.IP) (release func(), err error) {
+	client := ip.String()
+	subnet := ip.Mask(net.CIDRMask(24, 32)).String()
+	if ip.To4() == nil {
+		// shouldn't happen since we drop IPv6 clients, but don't lump
+		// every IPv6 client into the same "subnet"
+		subnet = client
+	}
+
+	err = l.admit(client, subnet)
+	if err != nil {
+		throttledConns.Add(err.Error(), 1)
+		return nil, err
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { l.release(client) })
+	}, nil
+}
+
+func (l *clientLimiter) admit(client, subnet string) error {
+	// check the concurrency limits before taking tokens, so a client that
+	// is sitting at its limit doesn't also drain its bucket
+	l.Lock()
+	defer l.Unlock()
+	if Conf.MaxConns > 0 && l.totalOpen >= Conf.MaxConns {
+		return ErrGlobalConnLimit
+	}
+	if Conf.MaxConnsPerClient > 0 && l.open[client] >= Conf.MaxConnsPerClient {
+		return ErrClientConnLimit
+	}
+
+	// only take tokens once both buckets say yes, so a client in a busy /24
+	// doesn't use up its own budget without ever getting through. Holding
+	// l's lock keeps anyone else from taking them in between.
+	if !l.clientRate.ready(client, Conf.ClientConnRate, Conf.ClientConnBurst) {
+		return ErrClientRateLimited
+	}
+	if !l.subnetRate.ready(subnet, Conf.SubnetConnRate, Conf.SubnetConnBurst) {
+		return ErrSubnetRateLimited
+	}
+	l.clientRate.take(client, Conf.ClientConnRate)
+	l.subnetRate.take(subnet, Conf.SubnetConnRate)
+
+	l.open[client]++
+	l.totalOpen++
+	return nil
+}
+
+func (l *clientLimiter) release(client string) {
+	l.Lock()
+	defer l.Unlock()
+	l.open[client]--
+	if l.open[client] <= 0 {
+		delete(l.open, client)
+	}
+	l.totalOpen--
+}
+
+// a token bucket per key
+type rateLimiter struct {
+	sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// how often to forget about keys whose buckets have refilled
+const rateLimiterSweepInterval = time.Minute
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// refill b for the time since it was last used
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+}
+
+// report whether key's bucket has a token. The bucket holds up to burst
+// tokens and refills at rate tokens per second. A rate of 0 disables the
+// limit.
+func (r *rateLimiter) ready(key string, rate float64, burst int) bool {
+	if rate <= 0 {
+		return true
+	}
+	burst = max(burst, 1)
+
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+
+	if now.Sub(r.lastSweep) > rateLimiterSweepInterval {
+		// a full bucket is the same as no bucket
+		for k, b := range r.buckets {
+			b.refill(now, rate, burst)
+			if b.tokens >= float64(burst) {
+				delete(r.buckets, k)
+			}
+		}
+		r.lastSweep = now
+	}
+
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		r.buckets[key] = b
+	}
+	b.refill(now, rate, burst)
+	return b.tokens >= 1
+}
+
+// take a token from key's bucket. Call ready first.
+func (r *rateLimiter) take(key string, rate float64) {
+	if rate <= 0 {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	b, ok := r.buckets[key]
+	if ok {
+		b.tokens--
+	}
+}
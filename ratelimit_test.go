@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestClientLimiterSubnetRefusalKeepsClientTokens(t *testing.T) {
+	Conf.MaxConns, Conf.MaxConnsPerClient = 0, 0
+	Conf.ClientConnRate, Conf.ClientConnBurst = 0.001, 2
+	Conf.SubnetConnRate, Conf.SubnetConnBurst = 0.001, 1
+	l := &clientLimiter{
+		clientRate: newRateLimiter(),
+		subnetRate: newRateLimiter(),
+		open:       make(map[string]int),
+	}
+
+	_, err := l.Admit(net.ParseIP("192.0.2.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		_, err = l.Admit(net.ParseIP("192.0.2.2"))
+		if !errors.Is(err, ErrSubnetRateLimited) {
+			t.Fatalf("err = %v, want ErrSubnetRateLimited", err)
+		}
+	}
+	if tokens := l.clientRate.buckets["192.0.2.2"].tokens; tokens < 2 {
+		t.Errorf("client has %v tokens left, want 2", tokens)
+	}
+}
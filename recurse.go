@@ -65,8 +65,15 @@ func serveRecurseMode(mode string, tf *TableFlip) {
 		}
 	}
 
+	tf.OnExit(func() {
+		s.Shutdown()
+	})
+
+	// ActivateAndServe returns nil after Shutdown
 	err := s.ActivateAndServe()
-	panic(err)
+	if err != nil {
+		panic(err)
+	}
 }
 
 func lookupNS(
@@ -79,6 +86,10 @@ func lookupNS(
 	// short-circuit DNS resolution of the nameserver for *.withfallback.com
 	ip := IPv6Extract(dnsServer)
 	if ip != nil {
+		err := CheckBackendAddr(ip)
+		if err != nil {
+			return nil, false, err
+		}
 		dnsServer = "[" + ip.String() + "]"
 	}
 
@@ -313,6 +324,9 @@ func (mode recurseMode) handle(resp dns.ResponseWriter, req *dns.Msg) {
 				log("refusing query for zone owner:", nameServer)
 				m.Authoritative = false
 				m.SetRcode(req, dns.RcodeNotAuth)
+			} else if err := CheckBackendAddr(ip); err != nil {
+				log("refusing to proxy query:", err)
+				m.SetRcode(req, dns.RcodeRefused)
 			} else {
 				// proxy the request
 				dialAddr := fmt.Sprintf("[%s]:53", ip)
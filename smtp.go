@@ -3,99 +3,345 @@ package main
 import (
 	"fmt"
 	"io"
+	"regexp"
+	"slices"
 	"strings"
 )
 
 const SMTPPort = 25
+const SubmissionPort = 587
 
-// read from an io.Reader up to and including the next occurrence of the
-// indicated byte
-func eatUntil(r io.Reader, b byte) (n int, err error) {
-	buff := make([]byte, 1)
-	for {
-		nn, err := io.ReadFull(r, buff)
-		n += nn
-		if err != nil {
-			return n, err
+// the commands a client might start with
+var rSMTPIdentifier = regexp.MustCompile(`(?i)^(?:HELO|EHLO|MAIL|RCPT|NOOP|RSET|VRFY|HELP|QUIT)(?: |\r?\n)`)
+var rSMTPReplyLine = regexp.MustCompile(`^[2-5][0-9]{2}[ \r\n-]`)
+var rSMTPRCPTCommand = regexp.MustCompile(`(?i)^RCPT TO: *(?:<[^<>@ ]+@([^<> ]+)>|[^<>@ ]+@([^<> ]+))(?: .*)?$`)
+
+// what we tell EHLO clients we can do. We answer each command as it arrives,
+// so pipelining is no problem.
+var smtpExtensions = []string{"PIPELINING"}
+
+// SMTP based on the SNI in the ClientHello if the client uses STARTTLS, or
+// else the host part of the TO address
+type smtpIdentifier struct {
+	port uint
+	// whether we offer STARTTLS. Once a client starts TLS, SNI is all we
+	// have to route on, and MTAs (ex: Postfix) don't send it by default.
+	// Submission clients check the certificate against the hostname, so
+	// they do.
+	startTLS bool
+}
+
+func init() {
+	RegisterIdentifier("smtp", smtpIdentifier{port: SMTPPort})
+	RegisterIdentifier("submission", smtpIdentifier{port: SubmissionPort, startTLS: true})
+}
+
+func (id smtpIdentifier) Ports() []uint {
+	return []uint{id.port}
+}
+
+func (smtpIdentifier) Match(b []byte) float64 {
+	if rSMTPIdentifier.Match(b) {
+		return 1
+	}
+	return 0
+}
+
+// what we know about an SMTP session up to STARTTLS or the first RCPT
+// command we can route on
+type smtpSession struct {
+	// whether we answer STARTTLS
+	offerStartTLS bool
+	// the client's last HELO or EHLO line
+	hello string
+	// the MAIL FROM line for the current transaction
+	mail string
+	// the offset of the RCPT line we route on, or -1 if we haven't seen one
+	rcpt       int
+	rcptDomain string
+	// the offset just past the STARTTLS line, or -1 if the client hasn't
+	// started TLS
+	startTLS int
+	// the offset just past the last line we answered
+	answered int
+}
+
+// readSMTPSession goes through the client's commands in b. reply (which may
+// be nil) is called with our reply to each command and the offset just past
+// the line it answers. We stop at the first RCPT command we can route on,
+// since the backend gets to answer that, or after STARTTLS, since the rest
+// is encrypted.
+func readSMTPSession(
+	b []byte,
+	offerStartTLS bool,
+	reply func(reply string, end int) error,
+) (s smtpSession, err error) {
+	s.offerStartTLS = offerStartTLS
+	s.rcpt = -1
+	s.startTLS = -1
+	for s.startTLS == -1 {
+		line, end, ok := nextLine(b, s.answered)
+		if !ok {
+			return s, nil
+		}
+		r, upgrade, quitErr := s.command(line)
+		if s.rcptDomain != "" {
+			s.rcpt = s.answered
+			return s, nil
+		}
+		if reply != nil {
+			err = reply(r, end)
+			if err != nil {
+				return s, err
+			}
+		}
+		s.answered = end
+		if quitErr != nil {
+			return s, quitErr
 		}
-		if buff[0] == b {
-			break
+		if upgrade {
+			s.startTLS = end
 		}
 	}
-	return n, nil
+	return s, nil
 }
 
-// assuming the reader is currently at the start of an SMTP reply with the
-// given code, this will read until the end of that reply.
-func eatSMTPReply(r io.Reader, code uint) (n int, err error) {
-	codeBytes := make([]byte, 3)
-	n, err = io.ReadFull(r, codeBytes)
-	if err != nil {
-		return n, err
-	}
-	if string(codeBytes) != fmt.Sprint(code) {
-		return n, fmt.Errorf("unexpected SMTP reply: %s (expected %d)",
-			codeBytes, code)
+// update the session for a command line and return our reply. If this is a
+// RCPT command we can route on, rcptDomain is set and there is no reply.
+// upgrade is true if the client should start TLS next.
+func (s *smtpSession) command(line string) (reply string, upgrade bool, err error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "500 Empty command\r\n", false, nil
 	}
+	zone := strings.TrimSuffix(Conf.DNSZone, ".")
 
-	// space indicates this is the last line, hyphen indicates more lines
-	codeSeparator := make([]byte, 1)
-	nn, err := io.ReadFull(r, codeSeparator)
-	n += nn
-	if err != nil {
-		return n, err
-	}
-	switch codeSeparator[0] {
-	case ' ':
-		nn, err := eatUntil(r, '\n')
-		n += nn
-		return n, err
-	case '-':
-		nn, err := eatUntil(r, '\n')
-		n += nn
-		if err != nil {
-			return n, err
+	switch strings.ToUpper(fields[0]) {
+	case "HELO", "EHLO":
+		if len(fields) < 2 {
+			return "501 Syntax: " + fields[0] + " <domain>\r\n", false, nil
+		}
+		// this starts over, same as RSET
+		s.hello = line
+		s.mail = ""
+		if strings.EqualFold(fields[0], "HELO") {
+			return "250 " + zone + "\r\n", false, nil
+		}
+		reply = "250-" + zone + " Hello " + fields[1] + "\r\n"
+		extensions := smtpExtensions
+		if s.offerStartTLS {
+			extensions = append(slices.Clip(extensions), "STARTTLS")
+		}
+		for i, ext := range extensions {
+			if i == len(extensions)-1 {
+				reply += "250 " + ext + "\r\n"
+			} else {
+				reply += "250-" + ext + "\r\n"
+			}
+		}
+		return reply, false, nil
+	case "MAIL":
+		switch {
+		case s.hello == "":
+			return "503 Send HELO or EHLO first\r\n", false, nil
+		case s.mail != "":
+			return "503 Nested MAIL command\r\n", false, nil
+		case !strings.HasPrefix(strings.ToUpper(line), "MAIL FROM:"):
+			return "501 Syntax: MAIL FROM:<address>\r\n", false, nil
+		}
+		s.mail = line
+		return "250 OK\r\n", false, nil
+	case "RCPT":
+		if s.mail == "" {
+			return "503 Need MAIL command first\r\n", false, nil
 		}
-		return eatSMTPReply(r, code)
+		matches := rSMTPRCPTCommand.FindStringSubmatch(line)
+		if matches == nil {
+			// ex: postmaster with no domain
+			return "501 Syntax: RCPT TO:<user@domain> (this proxy needs the domain to know where to send you)\r\n", false, nil
+		}
+		s.rcptDomain = matches[1] + matches[2]
+		return "", false, nil
+	case "DATA", "BDAT":
+		if s.mail == "" {
+			return "503 Need MAIL command first\r\n", false, nil
+		}
+		return "503 Need RCPT command first\r\n", false, nil
+	case "STARTTLS":
+		switch {
+		case !s.offerStartTLS:
+			return "502 Command not implemented\r\n", false, nil
+		case len(fields) != 1:
+			return "501 Syntax: STARTTLS\r\n", false, nil
+		case !strings.HasPrefix(strings.ToUpper(s.hello), "EHLO "):
+			// STARTTLS is an extension, so HELO doesn't count
+			return "503 Send EHLO first\r\n", false, nil
+		case s.mail != "":
+			return "503 STARTTLS is not allowed during a mail transaction\r\n", false, nil
+		}
+		// the rest of the session happens inside TLS
+		return "220 Ready to start TLS\r\n", true, nil
+	case "RSET":
+		s.mail = ""
+		return "250 OK\r\n", false, nil
+	case "NOOP":
+		return "250 OK\r\n", false, nil
+	case "VRFY":
+		return "252 Cannot VRFY user, but will accept message and attempt delivery\r\n", false, nil
+	case "HELP":
+		return "214 " + zone + " is an IPv4 to IPv6 reverse proxy. Send a RCPT command and I will connect you to the real mail server\r\n", false, nil
+	case "QUIT":
+		return "221 Bye\r\n", false, ErrClientQuit
 	default:
-		return n, fmt.Errorf("unexpected character after SMTP code: %s",
-			codeSeparator)
+		return "502 Command not implemented\r\n", false, nil
 	}
 }
 
-// eat 220, 250, 250, which should get us to the point where we are ready to
-// connect the client to the server.
-func EatSMTP(upstream io.Reader) (n int, err error) {
-	// eat server welcome banner
-	n, err = eatSMTPReply(upstream, 220)
+func (id smtpIdentifier) NeedMore(b []byte) bool {
+	s, _ := readSMTPSession(b, id.startTLS, nil)
+	if s.startTLS != -1 {
+		return startTLSNeedMore(b, s.startTLS)
+	}
+	return s.rcpt == -1
+}
+
+func (id smtpIdentifier) Hosts(b []byte, log func(...interface{})) []string {
+	s, _ := readSMTPSession(b, id.startTLS, nil)
+	if s.startTLS != -1 {
+		// the RCPT command (if any) is encrypted, so SNI is all we get
+		return startTLSHosts(b, s.startTLS, log)
+	}
+	if s.rcptDomain == "" {
+		log("no RCPT command")
+		return nil
+	}
+
+	// spec says we should prefer MX records but fall back to A/AAAA
+	hosts, err := IPv6LookupMX(s.rcptDomain)
 	if err != nil {
-		return n, err
+		// no MX records means the domain is its own mail server. If the
+		// lookup failed for some other reason, dialing will probably fail
+		// too, and the client will be told to try again later.
+		log("error looking up MX records:", err)
+		log("falling back to AAAA")
+		return []string{s.rcptDomain}
+	}
+	if len(hosts) == 0 {
+		log("none of the MX records for", s.rcptDomain, "have an IPv6 address")
+		return nil
 	}
-	// client sends hello
-	// eat server OK
-	nn, err := eatSMTPReply(upstream, 250)
-	n += nn
+	return hosts
+}
+
+func (id smtpIdentifier) UsedSNI(b []byte) bool {
+	s, _ := readSMTPSession(b, id.startTLS, nil)
+	return s.startTLS != -1
+}
+
+func (smtpIdentifier) Greet(client io.Writer) (n int, err error) {
+	return fmt.Fprintf(client,
+		"220 %s ESMTP this is an IPv4 to IPv6 reverse proxy\r\n",
+		strings.TrimSuffix(Conf.DNSZone, "."),
+	)
+}
+
+func (id smtpIdentifier) Respond(client io.Writer, b []byte, answered int) (int, error) {
+	s, err := readSMTPSession(b, id.startTLS, func(reply string, end int) error {
+		if end <= answered {
+			// we already sent this one
+			return nil
+		}
+		_, err := io.WriteString(client, reply)
+		return err
+	})
+	return s.answered, err
+}
+
+// replay the client's HELO/EHLO and MAIL FROM (or STARTTLS) to the backend,
+// eating the replies, so it is ready for the RCPT command (or the TLS
+// handshake). If the backend rejects any of it, its reply goes to the client.
+func (id smtpIdentifier) Replay(backend io.ReadWriter, b []byte) ([]byte, error) {
+	s, _ := readSMTPSession(b, id.startTLS, nil)
+
+	// eat server welcome banner
+	err := expectSMTPReply(backend, 220)
 	if err != nil {
-		return n, err
+		return nil, err
+	}
+	for _, line := range []string{s.hello, s.mail} {
+		if line == "" {
+			continue
+		}
+		_, err = io.WriteString(backend, line+"\r\n")
+		if err != nil {
+			return nil, err
+		}
+		err = expectSMTPReply(backend, 250)
+		if err != nil {
+			return nil, err
+		}
 	}
-	// client sends FROM address
-	// eat server OK
-	nn, err = eatSMTPReply(upstream, 250)
-	n += nn
+
+	if s.startTLS != -1 {
+		_, err = io.WriteString(backend, "STARTTLS\r\n")
+		if err != nil {
+			return nil, err
+		}
+		err = expectSMTPReply(backend, 220)
+		if err != nil {
+			return nil, err
+		}
+		return b[s.startTLS:], nil
+	}
+	if s.rcpt == -1 {
+		// ex: a default backend for clients that never sent RCPT
+		return b[s.answered:], nil
+	}
+	return b[s.rcpt:], nil
+}
+
+// read the backend's reply to what we just sent. Any code other than the one
+// we expected means the backend refused, and the client should hear why.
+func expectSMTPReply(r io.Reader, code uint) error {
+	reply, err := readSMTPReply(r)
 	if err != nil {
-		return n, err
+		return err
+	}
+	if string(reply[:3]) != fmt.Sprint(code) {
+		return &BackendReplyError{Reply: reply}
 	}
-	// client sends TO address
-	return n, nil
+	return nil
 }
 
-// Ideally we would actually look at what the client is sending us, but
-// for simplicity we are just going to send all the replies the client
-// expects from us all at once.
-func StuffSMTP(client io.Writer) (n int, err error) {
-	n, err = client.Write([]byte("220 " + strings.TrimSuffix(Conf.DNSZone, ".") + " this is an IPv4 to IPv6 reverse proxy\r\n" +
-		"250 I'm blindly accepting that command so we can get to the part where you tell me who you want to talk to\r\n" +
-		"250 Once you send me a TO address I will connect you to the real mail server\r\n",
-	))
-	return n, err
+// read a whole SMTP reply, including every line of a multi-line reply. This
+// reads a byte at a time so nothing after the reply is lost.
+func readSMTPReply(r io.Reader) ([]byte, error) {
+	var reply []byte
+	buff := make([]byte, 1)
+	for {
+		lineStart := len(reply)
+		for {
+			_, err := io.ReadFull(r, buff)
+			if err != nil {
+				return nil, err
+			}
+			reply = append(reply, buff[0])
+			if buff[0] == '\n' {
+				break
+			}
+			if len(reply)-lineStart >= maxReplayLine {
+				return nil, fmt.Errorf("SMTP reply line too long")
+			}
+		}
+
+		line := reply[lineStart:]
+		if !rSMTPReplyLine.Match(line) || string(line[:3]) != string(reply[:3]) {
+			return nil, fmt.Errorf("malformed SMTP reply: %q", line)
+		}
+		// space (or nothing) indicates this is the last line, hyphen
+		// indicates more lines
+		if line[3] != '-' {
+			return reply, nil
+		}
+	}
 }
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestReadSMTPSession(t *testing.T) {
+	Conf.DNSZone = "proxy.example."
+	tests := []struct {
+		name       string
+		in         string
+		replies    string
+		rcptDomain string
+		rcpt       int
+		answered   int
+		err        error
+	}{
+		{
+			"HELO",
+			"HELO client.example\r\n",
+			"250 proxy.example\r\n",
+			"", -1, 21, nil,
+		},
+		{
+			"EHLO",
+			"EHLO client.example\r\n",
+			"250-proxy.example Hello client.example\r\n250 PIPELINING\r\n",
+			"", -1, 21, nil,
+		},
+		{
+			"pipelined MAIL and RCPT",
+			"EHLO c\r\nMAIL FROM:<a@c.example>\r\nRCPT TO:<b@d.example>\r\nDATA\r\n",
+			"250-proxy.example Hello c\r\n250 PIPELINING\r\n250 OK\r\n",
+			"d.example", 33, 33, nil,
+		},
+		{
+			"RCPT without brackets",
+			"HELO c\r\nMAIL FROM:<>\r\nRCPT TO:b@d.example\r\n",
+			"250 proxy.example\r\n250 OK\r\n",
+			"d.example", 22, 22, nil,
+		},
+		{
+			"RCPT without a domain",
+			"HELO c\r\nMAIL FROM:<>\r\nRCPT TO:<postmaster>\r\n",
+			"250 proxy.example\r\n250 OK\r\n501 Syntax: RCPT TO:<user@domain> (this proxy needs the domain to know where to send you)\r\n",
+			"", -1, 44, nil,
+		},
+		{
+			"MAIL before HELO",
+			"MAIL FROM:<a@c.example>\r\n",
+			"503 Send HELO or EHLO first\r\n",
+			"", -1, 25, nil,
+		},
+		{
+			"nested MAIL",
+			"HELO c\r\nMAIL FROM:<>\r\nMAIL FROM:<>\r\n",
+			"250 proxy.example\r\n250 OK\r\n503 Nested MAIL command\r\n",
+			"", -1, 36, nil,
+		},
+		{
+			"RSET ends the transaction",
+			"HELO c\r\nMAIL FROM:<>\r\nRSET\r\nRCPT TO:<b@d.example>\r\n",
+			"250 proxy.example\r\n250 OK\r\n250 OK\r\n503 Need MAIL command first\r\n",
+			"", -1, 51, nil,
+		},
+		{
+			"STARTTLS isn't offered",
+			"EHLO c\r\nSTARTTLS\r\n",
+			"250-proxy.example Hello c\r\n250 PIPELINING\r\n502 Command not implemented\r\n",
+			"", -1, 18, nil,
+		},
+		{
+			"incomplete line",
+			"HELO c\r\nMAIL FR",
+			"250 proxy.example\r\n",
+			"", -1, 8, nil,
+		},
+		{
+			"QUIT",
+			"HELO c\r\nQUIT\r\nNOOP\r\n",
+			"250 proxy.example\r\n221 Bye\r\n",
+			"", -1, 14, ErrClientQuit,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var replies bytes.Buffer
+			s, err := readSMTPSession([]byte(tt.in), false, func(reply string, end int) error {
+				replies.WriteString(reply)
+				return nil
+			})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if replies.String() != tt.replies {
+				t.Errorf("replies = %q, want %q", replies.String(), tt.replies)
+			}
+			if s.rcptDomain != tt.rcptDomain {
+				t.Errorf("rcptDomain = %q, want %q", s.rcptDomain, tt.rcptDomain)
+			}
+			if s.rcpt != tt.rcpt {
+				t.Errorf("rcpt = %d, want %d", s.rcpt, tt.rcpt)
+			}
+			if s.answered != tt.answered {
+				t.Errorf("answered = %d, want %d", s.answered, tt.answered)
+			}
+		})
+	}
+}
+
+func TestSMTPRespond(t *testing.T) {
+	Conf.DNSZone = "proxy.example."
+	in := []byte("HELO c\r\nNOOP\r\nMAIL FROM:<>\r\nRCPT TO:<b@d.example>\r\n")
+	tests := []struct {
+		name     string
+		answered int
+		out      string
+		end      int
+	}{
+		{"nothing answered yet", 0, "250 proxy.example\r\n250 OK\r\n250 OK\r\n", 28},
+		{"HELO already answered", 8, "250 OK\r\n250 OK\r\n", 28},
+		{"everything answered", 28, "", 28},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			end, err := smtpIdentifier{port: SMTPPort}.Respond(&out, in, tt.answered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.out {
+				t.Errorf("wrote %q, want %q", out.String(), tt.out)
+			}
+			if end != tt.end {
+				t.Errorf("answered = %d, want %d", end, tt.end)
+			}
+		})
+	}
+}
+
+func TestSMTPReplay(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend string
+		in      string
+		sent    string
+		rest    string
+		reply   string
+	}{
+		{
+			"pipelined",
+			"220 mx.example\r\n250 hi\r\n250 OK\r\n",
+			"EHLO c\r\nMAIL FROM:<>\r\nRCPT TO:<b@d.example>\r\nDATA\r\n",
+			"EHLO c\r\nMAIL FROM:<>\r\n",
+			"RCPT TO:<b@d.example>\r\nDATA\r\n",
+			"",
+		},
+		{
+			"multiline replies",
+			"220-mx.example\r\n220 ESMTP\r\n250-mx.example\r\n250-PIPELINING\r\n250 STARTTLS\r\n250 OK\r\n",
+			"EHLO c\r\nMAIL FROM:<>\r\nRCPT TO:<b@d.example>\r\n",
+			"EHLO c\r\nMAIL FROM:<>\r\n",
+			"RCPT TO:<b@d.example>\r\n",
+			"",
+		},
+		{
+			"no RCPT",
+			"220 mx.example\r\n250 hi\r\n",
+			"HELO c\r\nNOOP\r\n",
+			"HELO c\r\n",
+			"",
+			"",
+		},
+		{
+			"backend rejects MAIL",
+			"220 mx.example\r\n250 hi\r\n550-no\r\n550 really\r\n",
+			"HELO c\r\nMAIL FROM:<a@spam.example>\r\nRCPT TO:<b@d.example>\r\n",
+			"HELO c\r\nMAIL FROM:<a@spam.example>\r\n",
+			"",
+			"550-no\r\n550 really\r\n",
+		},
+		{
+			"backend busy",
+			"421 try later\r\n",
+			"HELO c\r\nMAIL FROM:<>\r\nRCPT TO:<b@d.example>\r\n",
+			"",
+			"",
+			"421 try later\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &scriptedBackend{Reader: bytes.NewBufferString(tt.backend)}
+			rest, err := smtpIdentifier{port: SMTPPort}.Replay(backend, []byte(tt.in))
+			if backend.sent.String() != tt.sent {
+				t.Errorf("sent %q, want %q", backend.sent.String(), tt.sent)
+			}
+			if tt.reply != "" {
+				var replyErr *BackendReplyError
+				if !errors.As(err, &replyErr) {
+					t.Fatalf("err = %v, want a BackendReplyError", err)
+				}
+				if string(replyErr.Reply) != tt.reply {
+					t.Errorf("reply = %q, want %q", replyErr.Reply, tt.reply)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(rest) != tt.rest {
+				t.Errorf("rest = %q, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func TestReadSMTPReply(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		reply   string
+		wantErr bool
+	}{
+		{"one line", "250 OK\r\nmore", "250 OK\r\n", false},
+		{"multiline", "250-a\r\n250-b\r\n250 c\r\nmore", "250-a\r\n250-b\r\n250 c\r\n", false},
+		{"bare LF", "250-a\n250 b\n", "250-a\n250 b\n", false},
+		{"code changes", "250-a\r\n251 b\r\n", "", true},
+		{"not a reply", "hello\r\n", "", true},
+		{"cut off", "250-a\r\n", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply, err := readSMTPReply(bytes.NewBufferString(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if string(reply) != tt.reply {
+				t.Errorf("reply = %q, want %q", reply, tt.reply)
+			}
+		})
+	}
+}
+
+func TestSMTPStartTLS(t *testing.T) {
+	Conf.DNSZone = "proxy.example."
+	tests := []struct {
+		name     string
+		in       string
+		replies  string
+		startTLS int
+	}{
+		{
+			"EHLO offers STARTTLS",
+			"EHLO c\r\n",
+			"250-proxy.example Hello c\r\n250-PIPELINING\r\n250 STARTTLS\r\n",
+			-1,
+		},
+		{
+			"before a transaction",
+			"EHLO c\r\nSTARTTLS\r\n\x16\x03\x01",
+			"250-proxy.example Hello c\r\n250-PIPELINING\r\n250 STARTTLS\r\n220 Ready to start TLS\r\n",
+			18,
+		},
+		{
+			"during a transaction",
+			"EHLO c\r\nMAIL FROM:<>\r\nSTARTTLS\r\n",
+			"250-proxy.example Hello c\r\n250-PIPELINING\r\n250 STARTTLS\r\n250 OK\r\n503 STARTTLS is not allowed during a mail transaction\r\n",
+			-1,
+		},
+		{
+			"after RSET",
+			"EHLO c\r\nMAIL FROM:<>\r\nRSET\r\nSTARTTLS\r\n",
+			"250-proxy.example Hello c\r\n250-PIPELINING\r\n250 STARTTLS\r\n250 OK\r\n250 OK\r\n220 Ready to start TLS\r\n",
+			38,
+		},
+		{
+			"after HELO",
+			"HELO c\r\nSTARTTLS\r\n",
+			"250 proxy.example\r\n503 Send EHLO first\r\n",
+			-1,
+		},
+		{
+			"with an argument",
+			"EHLO c\r\nSTARTTLS now\r\n",
+			"250-proxy.example Hello c\r\n250-PIPELINING\r\n250 STARTTLS\r\n501 Syntax: STARTTLS\r\n",
+			-1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var replies bytes.Buffer
+			s, err := readSMTPSession([]byte(tt.in), true, func(reply string, end int) error {
+				replies.WriteString(reply)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if replies.String() != tt.replies {
+				t.Errorf("replies = %q, want %q", replies.String(), tt.replies)
+			}
+			if s.startTLS != tt.startTLS {
+				t.Errorf("startTLS = %d, want %d", s.startTLS, tt.startTLS)
+			}
+		})
+	}
+}
+
+func TestSMTPReplayStartTLS(t *testing.T) {
+	backend := &scriptedBackend{Reader: bytes.NewBufferString(
+		"220 mx.example\r\n250-mx.example\r\n250 STARTTLS\r\n220 go ahead\r\n",
+	)}
+	rest, err := smtpIdentifier{port: SubmissionPort, startTLS: true}.Replay(
+		backend, []byte("EHLO c\r\nSTARTTLS\r\n\x16\x03\x01"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "EHLO c\r\nSTARTTLS\r\n"; backend.sent.String() != want {
+		t.Errorf("sent %q, want %q", backend.sent.String(), want)
+	}
+	if string(rest) != "\x16\x03\x01" {
+		t.Errorf("rest = %q, want the ClientHello", rest)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+var ErrClientQuit = errors.New("client quit before saying which vhost it wanted")
+
+// longer lines than this from a backend during a replay are probably not
+// the protocol we think they are
+const maxReplayLine = 4096
+
+// read one line (without its line ending) a byte at a time, so we don't
+// read past it. Anything after the line may be TLS or belong to the client.
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			return string(line), err
+		}
+		if b[0] == '\n' {
+			return string(bytes.TrimSuffix(line, []byte("\r"))), nil
+		}
+		if len(line) >= maxReplayLine {
+			return string(line), errors.New("line too long")
+		}
+		line = append(line, b[0])
+	}
+}
+
+// the next complete line in b starting at offset, without its line ending.
+// end is the offset just past the line. ok is false if there isn't a
+// complete line yet.
+func nextLine(b []byte, offset int) (line string, end int, ok bool) {
+	i := bytes.IndexByte(b[offset:], '\n')
+	if i == -1 {
+		return "", offset, false
+	}
+	end = offset + i + 1
+	return string(bytes.TrimSuffix(b[offset:end-1], []byte("\r"))), end, true
+}
+
+// find the first complete line in b that isUpgrade says starts TLS. end is
+// the offset just past it, or -1 if there isn't one yet. Everything after
+// end is the TLS handshake.
+func findStartTLS(b []byte, isUpgrade func(line string) bool) (line string, end int) {
+	offset := 0
+	for {
+		line, end, ok := nextLine(b, offset)
+		if !ok {
+			return "", -1
+		}
+		if isUpgrade(line) {
+			return line, end
+		}
+		offset = end
+	}
+}
+
+// NeedMore for protocols that route on the SNI after STARTTLS (or similar)
+func startTLSNeedMore(b []byte, end int) bool {
+	return end == -1 || tlsIdentifier{}.NeedMore(b[end:])
+}
+
+// Hosts for protocols that route on the SNI after STARTTLS (or similar)
+func startTLSHosts(b []byte, end int, log func(...interface{})) []string {
+	if end == -1 {
+		log("client never started TLS")
+		return nil
+	}
+	return tlsIdentifier{}.Hosts(b[end:], log)
+}
+
+// Respond for protocols that route on the SNI after STARTTLS (or similar).
+// reply answers a single command line, and says if the client should start
+// TLS next.
+func startTLSRespond(
+	client io.Writer,
+	b []byte,
+	answered int,
+	reply func(line string) (string, bool, error),
+	isUpgrade func(line string) bool,
+) (int, error) {
+	_, end := findStartTLS(b[:answered], isUpgrade)
+	if end != -1 {
+		// everything after the upgrade is the TLS handshake
+		return answered, nil
+	}
+	for {
+		line, end, ok := nextLine(b, answered)
+		if !ok {
+			return answered, nil
+		}
+		r, upgrade, quitErr := reply(line)
+		_, err := io.WriteString(client, r)
+		if err != nil {
+			return answered, err
+		}
+		answered = end
+		if quitErr != nil {
+			return answered, quitErr
+		}
+		if upgrade {
+			return answered, nil
+		}
+	}
+}
@@ -16,6 +16,7 @@ type TableFlip struct {
 	*tableflip.Upgrader
 	sync.Mutex
 	transparent bool
+	exitFuncs   []func()
 }
 
 func SetupTableFlip() *TableFlip {
@@ -109,6 +110,26 @@ func (tf *TableFlip) Run() {
 	// block forever (or until we are signaled to upgrade)
 	<-tf.Exit()
 	Log("TableFlip completed upgrade")
+
+	// stop accepting new connections, then give existing connections a
+	// chance to finish before we exit.
+	tf.Lock()
+	exitFuncs := tf.exitFuncs
+	tf.Unlock()
+	for _, f := range exitFuncs {
+		f()
+	}
+	Log("Draining connections for up to", Conf.DrainTimeout.Duration)
+	drained, cut := ActiveConns.Drain(Conf.DrainTimeout.Duration)
+	Log("Drained", drained, "connections, cut", cut, "connections")
+}
+
+// OnExit registers a function to be called after a new process has taken
+// over. It should stop the caller from accepting new work.
+func (tf *TableFlip) OnExit(f func()) {
+	tf.Lock()
+	defer tf.Unlock()
+	tf.exitFuncs = append(tf.exitFuncs, f)
 }
 
 func (tf *TableFlip) ListenTransparent(network, address string) (net.Listener, error) {
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var errWriteStalled = errors.New("peer stopped reading")
+
+// returns the earlier of now+idle and deadline, treating zero values as
+// "no limit"
+func nextDeadline(idle time.Duration, deadline time.Time) time.Time {
+	if idle <= 0 {
+		return deadline
+	}
+	idleDeadline := time.Now().Add(idle)
+	if deadline.IsZero() || idleDeadline.Before(deadline) {
+		return idleDeadline
+	}
+	return deadline
+}
+
+// activity is when a connection last moved data in either direction. A
+// connection is only idle when both directions are quiet, so a download
+// doesn't get cut off just because the client has nothing to say.
+type activity struct {
+	last atomic.Int64
+}
+
+func (a *activity) touch() {
+	a.last.Store(time.Now().UnixNano())
+}
+
+// whether nothing has moved for idle. Always false with no idle timeout.
+func (a *activity) idleFor(idle time.Duration) bool {
+	return idle > 0 && time.Since(time.Unix(0, a.last.Load())) >= idle
+}
+
+// keepWaiting reports whether err is just one direction's idle deadline
+// passing while the other direction is still busy
+func keepWaiting(err error, act *activity, idle time.Duration, deadline time.Time) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded) &&
+		(deadline.IsZero() || time.Now().Before(deadline)) &&
+		!act.idleFor(idle)
+}
+
+// these intentionally do not embed *net.TCPConn. If they did, io.Copy would
+// use TCPConn's ReadFrom/WriteTo and skip our deadlines.
+type idleReader struct {
+	conn     *net.TCPConn
+	idle     time.Duration
+	deadline time.Time
+	act      *activity
+}
+
+func (r idleReader) Read(p []byte) (int, error) {
+	for {
+		r.conn.SetReadDeadline(nextDeadline(r.idle, r.deadline))
+		n, err := r.conn.Read(p)
+		if n > 0 {
+			r.act.touch()
+			return n, err
+		}
+		if keepWaiting(err, r.act, r.idle, r.deadline) {
+			continue
+		}
+		return n, err
+	}
+}
+
+type idleWriter struct {
+	conn     *net.TCPConn
+	idle     time.Duration
+	deadline time.Time
+	act      *activity
+}
+
+func (w idleWriter) Write(p []byte) (int, error) {
+	written := 0
+	for {
+		w.conn.SetWriteDeadline(nextDeadline(w.idle, w.deadline))
+		n, err := w.conn.Write(p[written:])
+		written += n
+		if n > 0 {
+			w.act.touch()
+		}
+		switch {
+		case err == nil:
+			return written, nil
+		case keepWaiting(err, w.act, w.idle, w.deadline):
+			continue
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			err = fmt.Errorf("%w: %w", errWriteStalled, err)
+		}
+		return written, err
+	}
+}
+
+// how much pipe copies between deadline updates
+const pipeChunk = 1 << 20
+
+// copy from src to dst until src closes, something errors, neither
+// direction (according to act) moves any data for longer than idle, or
+// deadline passes. The copy is slowed down to stay within slot's bandwidth
+// limits. Returns the number of bytes copied, a human readable reason for
+// stopping, and whether src closed cleanly.
+//
+// This lets the kernel splice data between the sockets without copying it
+// through userspace. The catch is that we only find out how much was copied
+// when ReadFrom returns, so a connection may sit idle for up to one and a
+// half times idle before we notice.
+func pipe(
+	dst, src *net.TCPConn,
+	dstName, srcName string,
+	idle time.Duration,
+	deadline time.Time,
+	slot *backendSlot,
+	act *activity,
+) (n int64, reason string, clean bool) {
+	chunk := slot.chunkSize()
+	for {
+		// wake up twice per idle period so the other direction can see
+		// that this one is busy
+		next := nextDeadline(idle/2, deadline)
+		src.SetReadDeadline(next)
+		dst.SetWriteDeadline(next)
+
+		// TCPConn.ReadFrom only splices from a TCPConn, or a TCPConn
+		// wrapped in a LimitedReader
+		nn, err := dst.ReadFrom(&io.LimitedReader{R: src, N: chunk})
+		n += nn
+		if nn > 0 {
+			act.touch()
+		}
+		slot.wait(nn)
+		switch {
+		case keepWaiting(err, act, idle, deadline):
+			// we hit the idle deadline, but something happened in one
+			// direction or the other
+			continue
+		case err != nil:
+			if errors.Is(err, os.ErrDeadlineExceeded) && unreadBytes(src) > 0 {
+				// src had more for us, so it was dst that stopped
+				err = fmt.Errorf("%w: %w", errWriteStalled, err)
+			}
+			return n, closeReason(dstName, srcName, idle, deadline, err), false
+		case nn < chunk:
+			// EOF
+			return n, closeReason(dstName, srcName, idle, deadline, nil), true
+		}
+	}
+}
+
+// the number of bytes the kernel has received on conn that we haven't read
+func unreadBytes(conn *net.TCPConn) int {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	var n int
+	raw.Control(func(fd uintptr) {
+		n, _ = unix.IoctlGetInt(int(fd), unix.SIOCINQ)
+	})
+	return n
+}
+
+func closeReason(
+	dstName, srcName string,
+	idle time.Duration,
+	deadline time.Time,
+	err error,
+) string {
+	switch {
+	case err == nil:
+		return srcName + " closed the connection"
+	case errors.Is(err, os.ErrDeadlineExceeded) && !deadline.IsZero() &&
+		!time.Now().Before(deadline):
+		return "max session time reached"
+	case errors.Is(err, errWriteStalled):
+		return fmt.Sprintf("%s stopped reading for %s", dstName, idle)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return fmt.Sprintf("no data in either direction for %s", idle)
+	default:
+		return fmt.Sprint("error: ", err)
+	}
+}
+
+// apply TCPKeepAlive to a socket. Zero leaves the Go defaults in place and
+// a negative value disables keepalives.
+func setKeepAlive(conn *net.TCPConn) {
+	switch {
+	case Conf.TCPKeepAlive.Duration > 0:
+		conn.SetKeepAlive(true)
+		conn.SetKeepAlivePeriod(Conf.TCPKeepAlive.Duration)
+	case Conf.TCPKeepAlive.Duration < 0:
+		conn.SetKeepAlive(false)
+	}
+}
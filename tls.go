@@ -5,9 +5,12 @@ import (
 	"crypto/tls"
 	"io"
 	"net"
+	"regexp"
 	"time"
 )
 
+var rTLSIdentifier = regexp.MustCompile(`^\x16\x03[\x00-\x06]`)
+
 type readOnlyConn struct {
 	io.Reader
 }
@@ -37,3 +40,33 @@ func ReadClientHello(b []byte) (*tls.ClientHelloInfo, error) {
 
 	return hello, nil
 }
+
+// TLS, based on SNI
+type tlsIdentifier struct{}
+
+func init() {
+	RegisterIdentifier("tls", tlsIdentifier{})
+}
+
+// a TLS handshake record header is only 3 bytes, so this is slightly more
+// likely to be a coincidence than the text based protocols
+func (tlsIdentifier) Match(b []byte) float64 {
+	if rTLSIdentifier.Match(b) {
+		return 0.9
+	}
+	return 0
+}
+
+func (tlsIdentifier) NeedMore(b []byte) bool {
+	_, err := ReadClientHello(b)
+	return err != nil
+}
+
+func (tlsIdentifier) Hosts(b []byte, log func(...interface{})) []string {
+	tlsInfo, _ := ReadClientHello(b)
+	if tlsInfo.ServerName == "" {
+		log("no SNI information")
+		return nil
+	}
+	return []string{tlsInfo.ServerName}
+}
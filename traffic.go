@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RecordTraffic adds one finished backend connection to the hourly totals
+// for its backend host and protocol.
+func RecordTraffic(
+	backend, protocol string,
+	bytesIn, bytesOut int64,
+	duration time.Duration,
+) error {
+	hour := time.Now().Truncate(time.Hour).Unix()
+	_, err := AbuseDB.Exec(`
+		INSERT INTO traffic (
+			hour,
+			backend,
+			protocol,
+			connections,
+			bytes_in,
+			bytes_out,
+			duration_ms
+		) VALUES (?, ?, ?, 1, ?, ?, ?)
+		ON CONFLICT(hour, backend, protocol) DO UPDATE SET
+			connections = connections + 1,
+			bytes_in = bytes_in + excluded.bytes_in,
+			bytes_out = bytes_out + excluded.bytes_out,
+			duration_ms = duration_ms + excluded.duration_ms
+	`, hour, backend, protocol, bytesIn, bytesOut, duration.Milliseconds())
+	return err
+}
+
+// record traffic for the current backend connection, then reset the
+// counters in case we connect to another one
+func (c *Conn) recordTraffic() {
+	if c.backendHost == "" {
+		return
+	}
+	err := RecordTraffic(
+		c.backendHost,
+		c.protocol,
+		c.bytesToBackend.Swap(0),
+		c.bytesToClient.Swap(0),
+		time.Since(c.backendStarted),
+	)
+	if err != nil {
+		c.Log("error recording traffic:", err)
+	}
+}
+
+// 1536 -> "1.5 KiB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// handleTrafficUI shows which backends use the most of the proxy.
+func handleTrafficUI(w http.ResponseWriter, r *http.Request) {
+	hours, err := strconv.Atoi(r.FormValue("hours"))
+	if err != nil || hours <= 0 {
+		hours = 24
+	}
+	since := time.Now().Truncate(time.Hour).Add(-time.Duration(hours-1) * time.Hour)
+
+	rows, err := AbuseDB.Query(`
+		SELECT
+			backend,
+			protocol,
+			SUM(connections),
+			SUM(bytes_in),
+			SUM(bytes_out),
+			SUM(duration_ms)
+		FROM traffic
+		WHERE hour >= ?
+		GROUP BY backend, protocol
+		ORDER BY SUM(bytes_in) + SUM(bytes_out) DESC
+		LIMIT 1000
+	`, since.Unix())
+	if err != nil {
+		Log("Error querying database:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	type usage struct {
+		Backend     string
+		Protocol    string
+		Connections int64
+		BytesIn     string
+		BytesOut    string
+		AvgDuration time.Duration
+	}
+	page := struct {
+		Hours int
+		Rows  []usage
+	}{Hours: hours}
+
+	for rows.Next() {
+		var u usage
+		var bytesIn, bytesOut, durationMS int64
+		err := rows.Scan(
+			&u.Backend,
+			&u.Protocol,
+			&u.Connections,
+			&bytesIn,
+			&bytesOut,
+			&durationMS,
+		)
+		if err != nil {
+			Log("Error scanning row:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		u.BytesIn = formatBytes(bytesIn)
+		u.BytesOut = formatBytes(bytesOut)
+		if u.Connections > 0 {
+			u.AvgDuration = (time.Duration(durationMS/u.Connections) * time.Millisecond).Round(time.Second)
+		}
+		page.Rows = append(page.Rows, u)
+	}
+
+	err = templates.ExecuteTemplate(w, "traffic.html", page)
+	if err != nil {
+		Log("Error executing template:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
@@ -7,6 +7,8 @@ if [ ! -f /run/uvhost-netsetup.done ] ; then
 
 	nft add chain ip uvhost mostports '{type filter hook input priority mangle;}'
 	nft add rule  ip uvhost mostports tcp dport 53 return
+	# FTPPassivePorts in config.toml. Vhosts are unreachable on these ports.
+	nft add rule  ip uvhost mostports tcp dport 50000-50999 return
 	nft add rule  ip uvhost mostports ip protocol tcp tproxy to 127.127.127.127:127
 
 	nft add chain ip uvhost nov4out '{type filter hook output priority filter; policy drop;}'